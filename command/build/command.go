@@ -2,6 +2,7 @@ package build
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	cmdcommon "github.com/mitchellh/packer/common/command"
@@ -21,6 +22,12 @@ func (Command) Help() string {
 }
 
 func (c Command) Run(env packer.Environment, args []string) int {
+	return c.RunContext(context.Background(), env, args)
+}
+
+// RunContext runs the builds like Run, but cancels them when the context
+// is done, the same as when Packer is interrupted.
+func (c Command) RunContext(ctx context.Context, env packer.Environment, args []string) int {
 	var cfgDebug bool
 	var cfgForce bool
 	var cfgParallel bool
@@ -131,6 +138,11 @@ func (c Command) Run(env packer.Environment, args []string) int {
 		}
 	}
 
+	// Closed on return so that the interrupt handlers below don't cancel
+	// builds that have already finished once the context is done later.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
 	// Run all the builds in parallel and wait for them to complete
 	var interruptWg, wg sync.WaitGroup
 	interrupted := false
@@ -145,7 +157,13 @@ func (c Command) Run(env packer.Environment, args []string) int {
 		signal.Notify(sigCh, os.Interrupt)
 		defer signal.Stop(sigCh)
 		go func(b packer.Build) {
-			<-sigCh
+			select {
+			case <-sigCh:
+			case <-ctx.Done():
+			case <-doneCh:
+				return
+			}
+
 			interruptWg.Add(1)
 			defer interruptWg.Done()
 			interrupted = true
@@ -23,6 +23,7 @@ func testEnvironment() packer.Environment {
 
 func TestCommand_Implements(t *testing.T) {
 	var _ packer.Command = new(Command)
+	var _ packer.ContextCommand = new(Command)
 }
 
 func TestCommand_Run_NoArgs(t *testing.T) {
@@ -188,7 +188,6 @@ func (b *coreBuild) Run(originalUi Ui, cache Cache) ([]Artifact, error) {
 		})
 	}
 
-	hook := &DispatchHook{Mapping: hooks}
 	artifacts := make([]Artifact, 0, 1)
 
 	// The builder just has a normal Ui, but targetted
@@ -197,6 +196,15 @@ func (b *coreBuild) Run(originalUi Ui, cache Cache) ([]Artifact, error) {
 		Ui:     originalUi,
 	}
 
+	// Let the user know right away about artifacts the builder makes
+	// before it is done.
+	hook := &DispatchHook{
+		Mapping: hooks,
+		ArtifactFunc: func(a Artifact) {
+			builderUi.Say(fmt.Sprintf("Artifact ready: %s", a.String()))
+		},
+	}
+
 	log.Printf("Running builder: %s", b.builderType)
 	builderArtifact, err := b.builder.Run(builderUi, hook, cache)
 	if err != nil {
@@ -1,5 +1,14 @@
 package packer
 
+import (
+	"errors"
+	"log"
+)
+
+// ErrNoEffectiveConfig is returned by EffectiveConfig for builders that
+// can't report their effective config.
+var ErrNoEffectiveConfig = errors.New("builder can't report its effective config")
+
 // Implementers of Builder are responsible for actually building images
 // on some platform given some configuration.
 //
@@ -34,3 +43,62 @@ type Builder interface {
 	// the builder actually cancels and cleans up after itself.
 	Cancel()
 }
+
+// BuilderIdentifier is implemented by builders that can report their
+// builder ID, which is the same ID as on the artifacts they create. It is
+// optional, so use BuilderId instead of calling it directly.
+type BuilderIdentifier interface {
+	BuilderId() string
+}
+
+// BuilderConfigurer is implemented by builders that apply defaults to
+// their configuration separately from validating it in Prepare. It is
+// optional, so use ConfigureBuilder instead of calling it directly.
+type BuilderConfigurer interface {
+	Configure(...interface{}) error
+}
+
+// BuilderConfigReporter is implemented by builders that can report the
+// configuration they ended up with after Prepare, with every raw config
+// merged and defaults applied, for debugging configs. It is optional, so
+// use EffectiveConfig instead of calling it directly.
+type BuilderConfigReporter interface {
+	EffectiveConfig() (map[string]interface{}, error)
+}
+
+// ConfigureBuilder configures the builder with the given raw configs. If
+// the builder doesn't implement BuilderConfigurer, then Prepare is called
+// instead, and any warnings it returns are logged.
+func ConfigureBuilder(b Builder, raws ...interface{}) error {
+	if bc, ok := b.(BuilderConfigurer); ok {
+		return bc.Configure(raws...)
+	}
+
+	warnings, err := b.Prepare(raws...)
+	for _, w := range warnings {
+		log.Printf("Builder warning: %s", w)
+	}
+
+	return err
+}
+
+// EffectiveConfig returns the configuration the builder ended up with
+// after Prepare. ErrNoEffectiveConfig is returned if the builder can't
+// report it.
+func EffectiveConfig(b Builder) (map[string]interface{}, error) {
+	if br, ok := b.(BuilderConfigReporter); ok {
+		return br.EffectiveConfig()
+	}
+
+	return nil, ErrNoEffectiveConfig
+}
+
+// BuilderId returns the builder ID reported by the builder, or an empty
+// string if the builder doesn't report one.
+func BuilderId(b Builder) string {
+	if bi, ok := b.(BuilderIdentifier); ok {
+		return bi.BuilderId()
+	}
+
+	return ""
+}
@@ -1,5 +1,9 @@
 package packer
 
+import (
+	"context"
+)
+
 // A command is a runnable sub-command of the `packer` application.
 // When `packer` is called with the proper subcommand, this will be
 // called.
@@ -21,3 +25,13 @@ type Command interface {
 	// This should be less than 50 characters ideally.
 	Synopsis() string
 }
+
+// ContextCommand is implemented by commands that can be stopped before
+// they finish. When the environment's CliContext is used, RunContext is
+// called instead of Run, and the command should stop and return once the
+// context is done.
+type ContextCommand interface {
+	Command
+
+	RunContext(ctx context.Context, env Environment, args []string) int
+}
@@ -1,5 +1,9 @@
 package packer
 
+import (
+	"context"
+)
+
 type TestCommand struct {
 	runArgs   []string
 	runCalled bool
@@ -20,3 +24,20 @@ func (tc *TestCommand) Run(env Environment, args []string) int {
 func (tc *TestCommand) Synopsis() string {
 	return "foo"
 }
+
+// TestContextCommand is a command that runs until its context is done.
+type TestContextCommand struct {
+	TestCommand
+
+	stopped bool
+}
+
+func (tc *TestContextCommand) RunContext(ctx context.Context, env Environment, args []string) int {
+	tc.runCalled = true
+	tc.runArgs = args
+	tc.runEnv = env
+
+	<-ctx.Done()
+	tc.stopped = true
+	return 1
+}
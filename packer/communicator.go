@@ -75,6 +75,45 @@ type Communicator interface {
 	Download(string, io.Writer) error
 }
 
+// TransferProgressFunc is called as an upload or download goes along,
+// with how many bytes have been transferred so far and how many there
+// are in total. The total is -1 if it isn't known.
+type TransferProgressFunc func(written, total int64)
+
+// ProgressCommunicator is implemented by a Communicator that can report
+// how far along its uploads and downloads are from where the transfer
+// really happens, such as the other end of an RPC connection. It is
+// optional, so use UploadWithProgress and DownloadWithProgress instead
+// of calling it directly.
+type ProgressCommunicator interface {
+	UploadWithProgress(path string, r io.Reader, total int64, fn TransferProgressFunc) error
+	DownloadWithProgress(path string, w io.Writer, fn TransferProgressFunc) error
+}
+
+// UploadWithProgress uploads a file like Communicator.Upload, calling fn
+// as the upload goes along. total is the size of the file, or -1 if it
+// isn't known. If the communicator can't report progress itself, then
+// the bytes read from r are counted instead.
+func UploadWithProgress(c Communicator, path string, r io.Reader, total int64, fn TransferProgressFunc) error {
+	if pc, ok := c.(ProgressCommunicator); ok {
+		return pc.UploadWithProgress(path, r, total, fn)
+	}
+
+	return c.Upload(path, &progressReader{r: r, total: total, fn: fn})
+}
+
+// DownloadWithProgress downloads a file like Communicator.Download,
+// calling fn as the download goes along. The total size of a download
+// is never known. If the communicator can't report progress itself,
+// then the bytes written to w are counted instead.
+func DownloadWithProgress(c Communicator, path string, w io.Writer, fn TransferProgressFunc) error {
+	if pc, ok := c.(ProgressCommunicator); ok {
+		return pc.DownloadWithProgress(path, w, fn)
+	}
+
+	return c.Download(path, &progressWriter{w: w, fn: fn})
+}
+
 // StartWithUi runs the remote command and streams the output to any
 // configured Writers for stdout/stderr, while also writing each line
 // as it comes to a Ui.
@@ -180,6 +219,43 @@ func (r *RemoteCmd) Wait() {
 	<-r.exitCh
 }
 
+// progressReader is an io.Reader that reports how much has been read
+// from it.
+type progressReader struct {
+	r       io.Reader
+	written int64
+	total   int64
+	fn      TransferProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.written += int64(n)
+		r.fn(r.written, r.total)
+	}
+
+	return n, err
+}
+
+// progressWriter is an io.Writer that reports how much has been written
+// to it.
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	fn      TransferProgressFunc
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.written += int64(n)
+		w.fn(w.written, -1)
+	}
+
+	return n, err
+}
+
 // cleanOutputLine cleans up a line so that '\r' don't muck up the
 // UI output when we're reading from a remote command.
 func (r *RemoteCmd) cleanOutputLine(line string) string {
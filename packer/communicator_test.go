@@ -60,3 +60,43 @@ func TestRemoteCmd_Wait(t *testing.T) {
 		t.Fatal("never got exit notification")
 	}
 }
+
+func TestUploadWithProgress(t *testing.T) {
+	c := new(MockCommunicator)
+
+	var written, total int64
+	fn := func(w, t int64) {
+		written, total = w, t
+	}
+
+	if err := UploadWithProgress(c, "foo", strings.NewReader("hello"), -1, fn); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.UploadData != "hello" {
+		t.Fatalf("bad: %s", c.UploadData)
+	}
+	if written != 5 || total != -1 {
+		t.Fatalf("bad: %d/%d", written, total)
+	}
+}
+
+func TestDownloadWithProgress(t *testing.T) {
+	c := new(MockCommunicator)
+	c.DownloadData = "hello"
+
+	var written, total int64
+	fn := func(w, t int64) {
+		written, total = w, t
+	}
+
+	var buf bytes.Buffer
+	if err := DownloadWithProgress(c, "foo", &buf, fn); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("bad: %s", buf.String())
+	}
+	if written != 5 || total != -1 {
+		t.Fatalf("bad: %d/%d", written, total)
+	}
+}
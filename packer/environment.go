@@ -2,6 +2,7 @@
 package packer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -201,7 +202,15 @@ func (e *coreEnvironment) Provisioner(name string) (p Provisioner, err error) {
 
 // Executes a command as if it was typed on the command-line interface.
 // The return value is the exit code of the command.
-func (e *coreEnvironment) Cli(args []string) (result int, err error) {
+func (e *coreEnvironment) Cli(args []string) (int, error) {
+	return e.CliContext(context.Background(), args)
+}
+
+// CliContext is like Cli, but stops the command once the context is done.
+// Commands that are a ContextCommand are stopped through RunContext. Other
+// commands can't be stopped, so CliContext returns ctx.Err() without
+// waiting for them and they keep running in the background.
+func (e *coreEnvironment) CliContext(ctx context.Context, args []string) (result int, err error) {
 	log.Printf("Environment.Cli: %#v\n", args)
 
 	// If we have no arguments, just short-circuit here and print the help
@@ -267,7 +276,32 @@ func (e *coreEnvironment) Cli(args []string) (result int, err error) {
 	}
 
 	log.Printf("Executing command: %s\n", args[0])
-	return command.Run(e, args[1:]), nil
+	return e.runCommand(ctx, command, args[1:])
+}
+
+// runCommand runs the command until it finishes or, if it can't be
+// stopped, until the context is done.
+func (e *coreEnvironment) runCommand(ctx context.Context, command Command, args []string) (int, error) {
+	if cc, ok := command.(ContextCommand); ok {
+		return cc.RunContext(ctx, e, args), nil
+	}
+
+	if ctx.Done() == nil {
+		return command.Run(e, args), nil
+	}
+
+	resultCh := make(chan int, 1)
+	go func() {
+		resultCh <- command.Run(e, args)
+	}()
+
+	select {
+	case result := <-resultCh:
+		return result, nil
+	case <-ctx.Done():
+		log.Printf("[WARN] Command can't be stopped, abandoning it: %#v", args)
+		return 1, ctx.Err()
+	}
 }
 
 // Prints the CLI help to the UI.
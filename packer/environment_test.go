@@ -2,6 +2,7 @@ package packer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io/ioutil"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -196,6 +198,88 @@ func TestEnvironment_Cli_CallsRun(t *testing.T) {
 	}
 }
 
+func TestEnvironment_CliContext_StopsCommand(t *testing.T) {
+	command := &TestContextCommand{}
+	config := &EnvironmentConfig{}
+	config.Commands = []string{"foo"}
+	config.Components.Command = func(n string) (Command, error) { return command, nil }
+
+	env, _ := NewEnvironment(config)
+	cc, ok := env.(interface {
+		CliContext(context.Context, []string) (int, error)
+	})
+	if !ok {
+		t.Fatal("environment should have CliContext")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	doneCh := make(chan struct{})
+	var exitCode int
+	var err error
+	go func() {
+		defer close(doneCh)
+		exitCode, err = cc.CliContext(ctx, []string{"foo", "bar"})
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CliContext should return once the context is done")
+	}
+
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if exitCode != 1 {
+		t.Fatalf("bad: %d", exitCode)
+	}
+	if !command.stopped {
+		t.Fatal("command should be stopped")
+	}
+	if !reflect.DeepEqual(command.runArgs, []string{"bar"}) {
+		t.Fatalf("bad: %#v", command.runArgs)
+	}
+}
+
+func TestEnvironment_CliContext_Abandons(t *testing.T) {
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+
+	command := &blockingCommand{blockCh}
+	config := &EnvironmentConfig{}
+	config.Commands = []string{"foo"}
+	config.Components.Command = func(n string) (Command, error) { return command, nil }
+
+	env, _ := NewEnvironment(config)
+	cc := env.(interface {
+		CliContext(context.Context, []string) (int, error)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := cc.CliContext(ctx, []string{"foo"})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+// blockingCommand is a command that can't be stopped and runs until
+// its channel is closed.
+type blockingCommand struct {
+	blockCh chan struct{}
+}
+
+func (*blockingCommand) Help() string     { return "" }
+func (*blockingCommand) Synopsis() string { return "" }
+
+func (c *blockingCommand) Run(Environment, []string) int {
+	<-c.blockCh
+	return 0
+}
+
 func TestEnvironment_DefaultCli_Empty(t *testing.T) {
 	defaultEnv := testEnvironment()
 
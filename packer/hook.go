@@ -25,10 +25,34 @@ type Hook interface {
 	Cancel()
 }
 
+// ArtifactHook is implemented by a Hook that wants to know about the
+// artifacts a builder makes while it is still running. It is optional,
+// so builders should use ReportArtifact instead of calling it directly.
+// An artifact from a plugin can only be used until Artifact returns, so
+// hooks must get what they need from it before then.
+type ArtifactHook interface {
+	Artifact(Artifact)
+}
+
+// ReportArtifact reports an artifact that a builder has finished making
+// to the hook given to its Run, before Run returns. Builders that make
+// several artifacts over a long run, such as an image in each of many
+// regions, can use this so that each is known as soon as it is ready.
+// The artifact returned from Run is still the result of the build.
+func ReportArtifact(hook Hook, a Artifact) {
+	if ah, ok := hook.(ArtifactHook); ok {
+		ah.Artifact(a)
+	}
+}
+
 // A Hook implementation that dispatches based on an internal mapping.
 type DispatchHook struct {
 	Mapping map[string][]Hook
 
+	// ArtifactFunc, if set, is called with every artifact reported to
+	// this hook with ReportArtifact.
+	ArtifactFunc func(Artifact)
+
 	l           sync.Mutex
 	cancelled   bool
 	runningHook Hook
@@ -73,6 +97,13 @@ func (h *DispatchHook) Run(name string, ui Ui, comm Communicator, data interface
 	return nil
 }
 
+// Artifact calls ArtifactFunc, if it is set, with the artifact.
+func (h *DispatchHook) Artifact(a Artifact) {
+	if h.ArtifactFunc != nil {
+		h.ArtifactFunc(a)
+	}
+}
+
 // Cancels all the hooks that are currently in-flight, if any. This will
 // block until the hooks are all cancelled.
 func (h *DispatchHook) Cancel() {
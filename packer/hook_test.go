@@ -69,6 +69,24 @@ func TestDispatchHook_Run(t *testing.T) {
 	}
 }
 
+func TestDispatchHook_Artifact(t *testing.T) {
+	var reported Artifact
+	dh := &DispatchHook{
+		ArtifactFunc: func(a Artifact) {
+			reported = a
+		},
+	}
+
+	artifact := new(MockArtifact)
+	ReportArtifact(dh, artifact)
+	if reported != artifact {
+		t.Fatalf("bad: %#v", reported)
+	}
+
+	// Without a func nothing happens
+	ReportArtifact(&DispatchHook{}, artifact)
+}
+
 func TestDispatchHook_cancel(t *testing.T) {
 	hook := new(CancelHook)
 
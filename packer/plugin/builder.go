@@ -19,6 +19,15 @@ func (b *cmdBuilder) Prepare(config ...interface{}) ([]string, error) {
 	return b.builder.Prepare(config...)
 }
 
+func (b *cmdBuilder) Configure(config ...interface{}) error {
+	defer func() {
+		r := recover()
+		b.checkExit(r, nil)
+	}()
+
+	return packer.ConfigureBuilder(b.builder, config...)
+}
+
 func (b *cmdBuilder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	defer func() {
 		r := recover()
@@ -28,6 +37,24 @@ func (b *cmdBuilder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 	return b.builder.Run(ui, hook, cache)
 }
 
+func (b *cmdBuilder) BuilderId() string {
+	defer func() {
+		r := recover()
+		b.checkExit(r, nil)
+	}()
+
+	return packer.BuilderId(b.builder)
+}
+
+func (b *cmdBuilder) EffectiveConfig() (map[string]interface{}, error) {
+	defer func() {
+		r := recover()
+		b.checkExit(r, nil)
+	}()
+
+	return packer.EffectiveConfig(b.builder)
+}
+
 func (b *cmdBuilder) Cancel() {
 	defer func() {
 		r := recover()
@@ -2,6 +2,9 @@ package plugin
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
@@ -12,8 +15,12 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
 )
@@ -22,9 +29,59 @@ import (
 // raised throughout the clients.
 var Killed = false
 
+// CleanupConcurrency is how many plugins CleanupClients kills at once,
+// so that a host managing many plugins doesn't signal and wait on all of
+// them at the same time. If it is 0 or less, they're all killed at once.
+var CleanupConcurrency = 16
+
+// This is how long Ping waits for the plugin to respond.
+var pingTimeout = 10 * time.Second
+
+// These are how many times connecting to a plugin is tried, and how long
+// to wait between tries.
+var dialAttempts = 5
+var dialRetryInterval = 50 * time.Millisecond
+
 // This is a slice of the "managed" clients which are cleaned up when
-// calling Cleanup
+// calling Cleanup. Access to it must be guarded by managedClientsLock.
 var managedClients = make([]*Client, 0, 5)
+var managedClientsLock sync.Mutex
+
+// sharedClients are the clients created with NewSharedClient, by key.
+// The refs and sharedKey fields of these clients are protected by
+// sharedClientsLock.
+var sharedClients = make(map[string]*Client)
+var sharedClientsLock sync.Mutex
+
+// pluginSlots limits how many plugin processes can run at once. It is
+// nil when there is no limit. See SetMaxConcurrentPlugins.
+var pluginSlots chan struct{}
+var pluginSlotsLock sync.Mutex
+
+// These are the errors returned when a plugin can't be started or
+// connected to. They are wrapped with more detail, so check for them
+// with errors.Is.
+var (
+	// ErrPluginTimeout is returned by Start if the plugin didn't send
+	// its address within StartTimeout.
+	ErrPluginTimeout = errors.New("timeout while waiting for plugin to start")
+
+	// ErrPluginExited is returned by Start if the plugin exited before
+	// it sent its address.
+	ErrPluginExited = errors.New("plugin exited before we could connect")
+
+	// ErrPluginDial is returned when getting a component from a started
+	// plugin if the plugin's address couldn't be connected to.
+	ErrPluginDial = errors.New("error connecting to plugin")
+)
+
+// errPluginRetry is returned by start when the plugin asks to be started
+// again.
+var errPluginRetry = errors.New("plugin asked to be started again")
+
+// stderrTailSize is how much of the end of a plugin's stderr is kept
+// around so it can be shown when the plugin fails.
+const stderrTailSize = 8 * 1024
 
 // Client handles the lifecycle of a plugin application, determining its
 // RPC address, and returning various types of packer interface implementations
@@ -32,9 +89,54 @@ var managedClients = make([]*Client, 0, 5)
 type Client struct {
 	config      *ClientConfig
 	exited      bool
+	started     bool
 	doneLogging chan struct{}
+	exitCh      chan struct{}
+	exitErr     *error
 	l           sync.Mutex
-	address     net.Addr
+
+	// procL guards config.Cmd, its Process, exitCh, doneLogging and
+	// rpcClient, which change every time the plugin is started. Kill
+	// uses this rather than l because Start holds l until the plugin is
+	// up.
+	procL sync.Mutex
+
+	address    net.Addr
+	startErr   error
+	exitState  *os.ProcessState
+	tlsConfig  *tls.Config
+	rpcClient  *packrpc.Client
+	apiVersion string
+	addresses  map[string]net.Addr
+	stderrTail *tailBuffer
+
+	// These are used to restart the plugin if it exits unexpectedly.
+	// killed is accessed atomically since Kill can't wait for Start
+	// to release the lock.
+	killed   int32
+	drained  int32
+	restart  bool
+	restarts int
+	cmdEnv   []string
+
+	// These are set for clients created with NewSharedClient.
+	sharedKey string
+	refs      int
+}
+
+// StartInfo is information about a started plugin process and the
+// handshake that was made with it.
+type StartInfo struct {
+	// The address the plugin is serving RPC on and the network of
+	// that address ("tcp" or "unix").
+	Address string
+	Network string
+
+	// The process ID of the plugin
+	PID int
+
+	// The API version that the plugin said it speaks
+	ProtocolVersion string
 }
 
 // ClientConfig is the configuration used to initialize a new
@@ -53,36 +155,171 @@ type ClientConfig struct {
 
 	// The minimum and maximum port to use for communicating with
 	// the subprocess. If not set, this defaults to 10,000 and 25,000
-	// respectively.
+	// respectively. If PACKER_PLUGIN_MIN_PORT or PACKER_PLUGIN_MAX_PORT
+	// are set in the environment of this process, they are used instead,
+	// so that an operator can set the port range of every plugin at once.
 	MinPort, MaxPort uint
 
+	// BindAddress is the IP address that the plugin listens on when it
+	// serves over TCP, which is only the case on Windows. If not set,
+	// the plugin only listens on 127.0.0.1 so that it can't be reached
+	// from other machines.
+	BindAddress string
+
+	// Dialer, if set, is used to connect to the address that the plugin
+	// is serving on, for example to set a dial timeout or to connect
+	// through a proxy. If not set, net.Dial is used. Every component
+	// from the client is served over this one connection.
+	Dialer func(network, addr string) (net.Conn, error)
+
 	// StartTimeout is the timeout to wait for the plugin to say it
-	// has started successfully.
+	// has started successfully. If not set, this defaults to one minute.
 	StartTimeout time.Duration
 
+	// KillTimeout is the time to wait for the plugin to exit on its own
+	// after being sent SIGTERM before it is forcibly killed. If not set,
+	// this defaults to 5 seconds. This has no effect on Windows, where
+	// plugins are always forcibly killed.
+	KillTimeout time.Duration
+
+	// DrainTimeout, if set, makes Kill first ask a connected plugin to
+	// stop accepting new work, such as Builder.Run, and wait up to this
+	// long for the work in progress to finish before the plugin is
+	// stopped. Drained reports whether that worked.
+	DrainTimeout time.Duration
+
+	// HeartbeatInterval, if set, makes the client ping the plugin this
+	// often once it is connected. If HeartbeatFailureThreshold pings in a
+	// row fail, which defaults to 3, the plugin is taken to be stuck and
+	// is killed, so that calls to it fail instead of hanging. This counts
+	// as a crash, so the plugin is restarted if Restart is set.
+	HeartbeatInterval         time.Duration
+	HeartbeatFailureThreshold int
+
+	// Env is extra environment variables, in the "key=value" form, to
+	// set for the plugin on top of the environment of this process.
+	// Dir, if set, is the working directory to start the plugin in.
+	// These are applied to Cmd when the plugin is started.
+	Env []string
+	Dir string
+
+	// CommandFunc, if set, makes the command that is actually run to
+	// start the plugin, given the path and arguments of Cmd. This lets
+	// the plugin be run inside of a sandbox or container by wrapping it
+	// in another command. The handshake is made with the plugin the same
+	// way, so the wrapping command must pass through its stdout and
+	// environment. If the returned command has no Env or Dir, those of
+	// Cmd are used.
+	CommandFunc func(path string, args []string) *exec.Cmd
+
 	// If non-nil, then the stderr of the client will be written to here
 	// (as well as the log).
 	Stderr io.Writer
+
+	// PassthroughOutput, if true, also writes the plugin's stderr, and
+	// anything it writes to stdout after the handshake, straight to the
+	// stderr of this process. This is meant for watching a plugin while
+	// developing it.
+	PassthroughOutput bool
+
+	// AutoMTLS, if true, makes the client and plugin generate a new
+	// certificate pair for every launch and speak RPC over mutually
+	// authenticated TLS. Other processes that find the plugin's address
+	// can then not speak to it. The plugin must be built with a version
+	// of Packer that supports this.
+	AutoMTLS bool
+
+	// Restart, if true, restarts the plugin if it exits without being
+	// killed. The plugin isn't restarted right away, but on the next call
+	// to Start, which every component lookup makes. Components that were
+	// returned before the plugin exited will continue to fail. The
+	// plugin is restarted at most MaxRestarts times, which defaults to 3.
+	Restart     bool
+	MaxRestarts int
+
+	// AllowRetry, if true, lets the plugin print RetryDirective instead
+	// of its address to be started again, for example after it has
+	// updated itself. The plugin is started again at most once, with
+	// RetryKey set in its environment.
+	AllowRetry bool
+
+	// Observer, if set, is told about the plugin being started and
+	// exiting, and about the RPC calls made to it.
+	Observer Observer
+
+	// Name is a short name for the plugin that its log lines are prefixed
+	// with, such as "amazon-ebs". If not set, the file name of Cmd is used.
+	Name string
+
+	// Secrets, if set, provides the credentials that the plugin can ask
+	// for with the Secrets func of this package. They are sent over the
+	// RPC connection when the plugin asks, rather than set in its
+	// environment where other processes can read them, so set AutoMTLS
+	// as well to keep them off the wire in clear text.
+	Secrets packrpc.SecretsProvider
+
+	// Kind is the kind of component the plugin provides, so that the host
+	// can tell its plugins apart without calling into them. It is shown in
+	// the log lines of CleanupClients.
+	Kind Kind
+
+	// Logger is where the client logs the plugin lifecycle and the
+	// plugin's stderr. If nil, the standard logger from the log package
+	// is used.
+	Logger *log.Logger
 }
 
 // This makes sure all the managed subprocesses are killed and properly
 // logged. This should be called before the parent process running the
 // plugins exits.
 //
-// This must only be called _once_.
+// This can safely be called multiple times. Each call only cleans up the
+// clients that were created since the last call.
 func CleanupClients() {
+	CleanupClientsContext(context.Background())
+}
+
+// CleanupClientsContext is like CleanupClients, but stops waiting for the
+// plugins to exit once the context is done, so that a stuck plugin can't
+// keep the host from exiting. The plugins that didn't exit in time are
+// logged.
+func CleanupClientsContext(ctx context.Context) {
 	// Set the killed to true so that we don't get unexpected panics
 	Killed = true
 
-	// Kill all the managed clients in parallel and use a WaitGroup
-	// to wait for them all to finish up.
+	// Take the current set of managed clients so that subsequent calls
+	// don't try to clean them up again.
+	managedClientsLock.Lock()
+	clients := managedClients
+	managedClients = make([]*Client, 0, 5)
+	managedClientsLock.Unlock()
+
+	// Kill the managed clients in parallel, at most CleanupConcurrency
+	// at a time, and use a WaitGroup to wait for them all to finish up.
+	var slots chan struct{}
+	if CleanupConcurrency > 0 {
+		slots = make(chan struct{}, CleanupConcurrency)
+	}
+
 	var wg sync.WaitGroup
-	for _, client := range managedClients {
+	for _, client := range clients {
 		wg.Add(1)
 
+		if slots != nil {
+			slots <- struct{}{}
+		}
+
 		go func(client *Client) {
-			client.Kill()
-			wg.Done()
+			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+
+			if err := client.KillContext(ctx); err != nil {
+				client.config.Logger.Printf(
+					"%s (%s): plugin didn't finish exiting: %s",
+					client.config.Name, client.config.Kind, err)
+			}
 		}(client)
 	}
 
@@ -90,6 +327,53 @@ func CleanupClients() {
 	wg.Wait()
 }
 
+// SetMaxConcurrentPlugins limits how many plugin processes can be running
+// at the same time. Once the limit is reached, Start blocks until one of
+// the running plugins exits, which keeps a host running many builds in
+// parallel from starting a process for every one of them at once. A
+// limit of 0, the default, means there is no limit.
+//
+// Changing the limit only affects plugins started afterwards.
+func SetMaxConcurrentPlugins(n int) {
+	pluginSlotsLock.Lock()
+	defer pluginSlotsLock.Unlock()
+
+	if n <= 0 {
+		pluginSlots = nil
+		return
+	}
+
+	pluginSlots = make(chan struct{}, n)
+}
+
+// acquirePluginSlot waits for a slot to run a plugin process in, and
+// returns the function that frees it again.
+func acquirePluginSlot(ctx context.Context, logger *log.Logger, name string) (func(), error) {
+	pluginSlotsLock.Lock()
+	slots := pluginSlots
+	pluginSlotsLock.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	logger.Printf("%s: waiting for a running plugin to exit before starting", name)
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Creates a new plugin client which manages the lifecycle of an external
 // plugin and gets the address for the RPC connection.
 //
@@ -107,18 +391,120 @@ func NewClient(config *ClientConfig) (c *Client) {
 		config.StartTimeout = 1 * time.Minute
 	}
 
+	if config.KillTimeout == 0 {
+		config.KillTimeout = 5 * time.Second
+	}
+
+	if config.HeartbeatInterval > 0 && config.HeartbeatFailureThreshold == 0 {
+		config.HeartbeatFailureThreshold = 3
+	}
+
+	if config.Restart && config.MaxRestarts == 0 {
+		config.MaxRestarts = 3
+	}
+
 	if config.Stderr == nil {
 		config.Stderr = ioutil.Discard
 	}
 
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+
+	if config.Name == "" {
+		config.Name = filepath.Base(config.Cmd.Path)
+	}
+
 	c = &Client{config: config}
 	if config.Managed {
+		managedClientsLock.Lock()
 		managedClients = append(managedClients, c)
+		managedClientsLock.Unlock()
 	}
 
 	return
 }
 
+// NewSharedClient returns the client that was created for the key with
+// NewSharedClient before, if it hasn't been killed, so that the same
+// plugin isn't started more than once. Otherwise a new client is created
+// from the config. If key is empty, the path of the command is used.
+//
+// Every component from a shared client is served by the same plugin
+// process, so only share plugins whose components can safely be used by
+// more than one caller. Each call must be paired with a call to Release,
+// and the plugin is killed once every caller has released it.
+func NewSharedClient(key string, config *ClientConfig) *Client {
+	if key == "" {
+		key = config.Cmd.Path
+	}
+
+	sharedClientsLock.Lock()
+	defer sharedClientsLock.Unlock()
+
+	if c, ok := sharedClients[key]; ok && c.reusable() {
+		c.refs++
+		return c
+	}
+
+	c := NewClient(config)
+	c.sharedKey = key
+	c.refs = 1
+	sharedClients[key] = c
+	return c
+}
+
+// Release releases a client created with NewSharedClient. The plugin is
+// killed once every caller of NewSharedClient has released it. For
+// clients that aren't shared, this is the same as Kill.
+func (c *Client) Release() {
+	sharedClientsLock.Lock()
+	if c.sharedKey != "" {
+		c.refs--
+		if c.refs > 0 {
+			sharedClientsLock.Unlock()
+			return
+		}
+	}
+	sharedClientsLock.Unlock()
+
+	c.Kill()
+}
+
+// reusable tells whether a shared client can be handed out again. It
+// doesn't take c.l, which Start holds until the plugin is up, so that a
+// slow plugin doesn't hold up the lookups of every other shared client.
+func (c *Client) reusable() bool {
+	if atomic.LoadInt32(&c.killed) == 1 {
+		return false
+	}
+
+	if c.config.Restart {
+		return true
+	}
+
+	c.procL.Lock()
+	exitCh := c.exitCh
+	c.procL.Unlock()
+
+	if exitCh == nil {
+		return true
+	}
+
+	select {
+	case <-exitCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// Kind returns the kind of component the plugin provides, as set in the
+// config.
+func (c *Client) Kind() Kind {
+	return c.config.Kind
+}
+
 // Tells whether or not the underlying process has exited.
 func (c *Client) Exited() bool {
 	c.l.Lock()
@@ -126,10 +512,124 @@ func (c *Client) Exited() bool {
 	return c.exited
 }
 
+// Wait blocks until the plugin process exits on its own and returns the
+// error from waiting on it, which is nil if the process exited cleanly.
+// An error is returned right away if the process was never started.
+//
+// Wait doesn't kill the plugin, so it is meant for plugins that finish
+// their work and exit. It is safe to call from multiple goroutines.
+func (c *Client) Wait() error {
+	c.l.Lock()
+	exitCh := c.exitCh
+	exitErr := c.exitErr
+	startErr := c.startErr
+	c.l.Unlock()
+
+	if exitCh == nil {
+		if startErr != nil {
+			return startErr
+		}
+
+		return errors.New("plugin process has not been started")
+	}
+
+	<-exitCh
+	return *exitErr
+}
+
+// ExitStatus returns the exit status of the plugin process. An error is
+// returned if the process hasn't exited yet.
+func (c *Client) ExitStatus() (int, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if !c.exited || c.exitState == nil {
+		return 0, errors.New("plugin process has not exited")
+	}
+
+	return c.exitState.ExitCode(), nil
+}
+
+// Ping checks that the plugin is still responding to RPC calls, returning
+// an error if it doesn't respond in time. If the client hasn't been
+// started, this will start it.
+func (c *Client) Ping() error {
+	client, err := c.RPCClient()
+	if err != nil {
+		return err
+	}
+
+	return pingWithTimeout(client, pingTimeout)
+}
+
+// pingWithTimeout pings the plugin over the given connection, returning
+// an error if it doesn't respond within the timeout.
+func pingWithTimeout(client *packrpc.Client, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Ping()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf(
+			"plugin didn't respond to ping after %s", timeout)
+	}
+}
+
+// heartbeat pings the plugin every HeartbeatInterval until it exits, and
+// kills it if it stops responding. Only an existing connection is used,
+// so the heartbeat never starts or connects to the plugin itself.
+func (c *Client) heartbeat(process *os.Process, exitCh <-chan struct{}) {
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-exitCh:
+			return
+		}
+
+		c.procL.Lock()
+		client := c.rpcClient
+		c.procL.Unlock()
+		if client == nil {
+			continue
+		}
+
+		err := pingWithTimeout(client, c.config.HeartbeatInterval)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		// Plugins built before Ping existed can't be checked at all
+		if err == packrpc.ErrPingUnsupported {
+			c.config.Logger.Printf(
+				"%s: plugin doesn't support heartbeats, stopping them", c.config.Name)
+			return
+		}
+
+		failures++
+		c.config.Logger.Printf("%s: plugin missed a heartbeat (%d/%d): %s",
+			c.config.Name, failures, c.config.HeartbeatFailureThreshold, err)
+		if failures >= c.config.HeartbeatFailureThreshold {
+			c.config.Logger.Printf(
+				"%s: plugin stopped responding, killing it", c.config.Name)
+			process.Kill()
+			return
+		}
+	}
+}
+
 // Returns a builder implementation that is communicating over this
 // client. If the client hasn't been started, this will start it.
 func (c *Client) Builder() (packer.Builder, error) {
-	client, err := c.packrpcClient()
+	client, err := c.RPCClient()
 	if err != nil {
 		return nil, err
 	}
@@ -140,7 +640,7 @@ func (c *Client) Builder() (packer.Builder, error) {
 // Returns a command implementation that is communicating over this
 // client. If the client hasn't been started, this will start it.
 func (c *Client) Command() (packer.Command, error) {
-	client, err := c.packrpcClient()
+	client, err := c.RPCClient()
 	if err != nil {
 		return nil, err
 	}
@@ -151,7 +651,7 @@ func (c *Client) Command() (packer.Command, error) {
 // Returns a hook implementation that is communicating over this
 // client. If the client hasn't been started, this will start it.
 func (c *Client) Hook() (packer.Hook, error) {
-	client, err := c.packrpcClient()
+	client, err := c.RPCClient()
 	if err != nil {
 		return nil, err
 	}
@@ -162,7 +662,7 @@ func (c *Client) Hook() (packer.Hook, error) {
 // Returns a post-processor implementation that is communicating over
 // this client. If the client hasn't been started, this will start it.
 func (c *Client) PostProcessor() (packer.PostProcessor, error) {
-	client, err := c.packrpcClient()
+	client, err := c.RPCClient()
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +673,7 @@ func (c *Client) PostProcessor() (packer.PostProcessor, error) {
 // Returns a provisioner implementation that is communicating over this
 // client. If the client hasn't been started, this will start it.
 func (c *Client) Provisioner() (packer.Provisioner, error) {
-	client, err := c.packrpcClient()
+	client, err := c.RPCClient()
 	if err != nil {
 		return nil, err
 	}
@@ -184,42 +684,318 @@ func (c *Client) Provisioner() (packer.Provisioner, error) {
 // End the executing subprocess (if it is running) and perform any cleanup
 // tasks necessary such as capturing any remaining logs and so on.
 //
-// This method blocks until the process successfully exits.
+// The process is first sent SIGTERM so that it has a chance to clean up,
+// and is forcibly killed if it hasn't exited after KillTimeout.
+//
+// This method blocks until the process successfully exits. Once killed,
+// a managed client is no longer tracked for CleanupClients.
 //
 // This method can safely be called multiple times.
 func (c *Client) Kill() {
-	cmd := c.config.Cmd
+	c.KillContext(context.Background())
+}
 
-	if cmd.Process == nil {
-		return
+// KillContext is like Kill, but stops waiting when the context is done
+// and returns the context's error. The process is still forcibly killed,
+// but its remaining logs may not have been captured yet.
+func (c *Client) KillContext(ctx context.Context) error {
+	if c.config.Managed {
+		c.forget()
+	}
+
+	// Mark that we killed the process so it isn't restarted
+	atomic.StoreInt32(&c.killed, 1)
+
+	// A killed client can't be shared anymore
+	c.forgetShared()
+
+	// Give the plugin a chance to finish what it is doing
+	if c.config.DrainTimeout > 0 {
+		c.drain(ctx)
+	}
+
+	c.procL.Lock()
+	process := c.config.Cmd.Process
+	exitCh := c.exitCh
+	doneLogging := c.doneLogging
+	c.procL.Unlock()
+
+	if process == nil {
+		return nil
+	}
+
+	// The command has a process but Start failed, for example because
+	// the command was already started by someone else. We never waited
+	// for the process or logged its stderr, so there is nothing to wait
+	// for.
+	if exitCh == nil {
+		process.Kill()
+		return nil
+	}
+
+	// Windows doesn't support SIGTERM, so there we go straight to
+	// killing the process.
+	if runtime.GOOS != "windows" {
+		if err := process.Signal(syscall.SIGTERM); err == nil {
+			select {
+			case <-exitCh:
+			case <-ctx.Done():
+			case <-time.After(c.config.KillTimeout):
+				c.config.Logger.Printf(
+					"%s: plugin didn't exit after SIGTERM, killing",
+					c.config.Name)
+			}
+		}
 	}
 
-	cmd.Process.Kill()
+	process.Kill()
+
+	// The connection is useless now that the plugin is gone
+	c.closeRPCClient()
 
 	// Wait for the client to finish logging so we have a complete log
-	<-c.doneLogging
+	select {
+	case <-doneLogging:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeRPCClient closes the connection to the plugin, if there is one,
+// and forgets it so that the next RPCClient connects again.
+func (c *Client) closeRPCClient() {
+	c.procL.Lock()
+	client := c.rpcClient
+	c.rpcClient = nil
+	c.procL.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+// Drained returns true if the plugin finished all of its work in progress
+// when it was killed. This is only ever true if DrainTimeout is set.
+func (c *Client) Drained() bool {
+	return atomic.LoadInt32(&c.drained) == 1
+}
+
+// drain asks the plugin to finish its work in progress, and records
+// whether it did. Nothing is done if we never connected to the plugin,
+// including while Start is still waiting for it.
+func (c *Client) drain(ctx context.Context) {
+	c.procL.Lock()
+	client := c.rpcClient
+	exitCh := c.exitCh
+	c.procL.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	select {
+	case <-exitCh:
+		return
+	default:
+	}
+
+	type result struct {
+		drained bool
+		err     error
+	}
+
+	resultCh := make(chan result, 1)
+	go func() {
+		drained, err := client.Shutdown(c.config.DrainTimeout)
+		resultCh <- result{drained, err}
+	}()
+
+	var r result
+	select {
+	case r = <-resultCh:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+
+	// Plugins built before draining existed have nothing to drain
+	if r.err == packrpc.ErrShutdownUnsupported {
+		return
+	}
+
+	if r.err != nil {
+		c.config.Logger.Printf(
+			"%s: error draining plugin: %s", c.config.Name, r.err)
+		return
+	}
+
+	if !r.drained {
+		c.config.Logger.Printf(
+			"%s: plugin didn't finish its work within %s",
+			c.config.Name, c.config.DrainTimeout)
+		return
+	}
+
+	atomic.StoreInt32(&c.drained, 1)
 }
 
 // Starts the underlying subprocess, communicating with it to negotiate
 // a port for RPC connections, and returning the address to connect via RPC.
 //
-// This method is safe to call multiple times. Subsequent calls have no effect.
-// Once a client has been started once, it cannot be started again, even if
-// it was killed.
+// This method is safe to call multiple times. Subsequent calls have no effect
+// and return the same address and error as the first call. Once a client has
+// been started once, it cannot be started again, even if it was killed or
+// failed to start.
 func (c *Client) Start() (addr net.Addr, err error) {
+	return c.StartContext(context.Background())
+}
+
+// Stderr returns the end of what the plugin has written to stderr, up to
+// the last 8 KB. This is meant for debugging plugins that fail to start.
+func (c *Client) Stderr() string {
+	c.l.Lock()
+	tail := c.stderrTail
+	c.l.Unlock()
+
+	if tail == nil {
+		return ""
+	}
+
+	return tail.String()
+}
+
+// Address returns the address the plugin advertised under the given
+// name, starting the plugin if it isn't already. Plugins advertise
+// named addresses with ServerWithAddresses, to serve things such as
+// bulk data separately from RPC. The RPC address is returned by Start.
+func (c *Client) Address(name string) (net.Addr, error) {
+	if _, err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	addr, ok := c.addresses[name]
+	if !ok {
+		return nil, fmt.Errorf("plugin has no address named: %s", name)
+	}
+
+	return addr, nil
+}
+
+// StartWithInfo is like Start, but returns more detailed information
+// about the started plugin, which is useful when debugging.
+func (c *Client) StartWithInfo() (*StartInfo, error) {
+	addr, err := c.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return &StartInfo{
+		Address:         addr.String(),
+		Network:         addr.Network(),
+		PID:             c.config.Cmd.Process.Pid,
+		ProtocolVersion: c.apiVersion,
+	}, nil
+}
+
+// StartContext is like Start, but if the context is cancelled before the
+// plugin reports its address, the subprocess is killed and the context's
+// error is returned.
+func (c *Client) StartContext(ctx context.Context) (addr net.Addr, err error) {
 	c.l.Lock()
 	defer c.l.Unlock()
 
-	if c.address != nil {
-		return c.address, nil
+	addr, err = c.start(ctx, false)
+	if err == errPluginRetry {
+		c.config.Logger.Printf("%s: plugin asked to be started again", c.config.Name)
+
+		// The plugin was killed when start returned, wait for it to
+		// exit before starting a fresh copy of it.
+		c.procL.Lock()
+		exitCh := c.exitCh
+		c.procL.Unlock()
+		<-exitCh
+
+		c.restart = true
+		addr, err = c.start(ctx, true)
 	}
 
-	c.doneLogging = make(chan struct{})
+	return
+}
+
+// start starts the plugin and makes the handshake with it. retrying is
+// true if the plugin asked to be started again. The lock must be held.
+func (c *Client) start(ctx context.Context, retrying bool) (addr net.Addr, err error) {
+	if c.started && !c.restart {
+		return c.address, c.startErr
+	}
+
+	if c.restart {
+		// The previous process exited on its own, so start a fresh copy
+		// of the command and forget everything about the old one.
+		c.restart = false
+		c.procL.Lock()
+		c.config.Cmd = c.restartCmd(c.config.Cmd)
+		c.procL.Unlock()
+		c.address = nil
+		c.apiVersion = ""
+		c.addresses = nil
+		c.exited = false
+		c.exitState = nil
+		c.tlsConfig = nil
+		c.closeRPCClient()
+	} else {
+		if c.config.CommandFunc != nil {
+			c.procL.Lock()
+			c.config.Cmd = c.wrapCmd(c.config.Cmd)
+			c.procL.Unlock()
+		}
+
+		c.cmdEnv = c.config.Cmd.Env
+	}
+
+	c.started = true
+	defer func() {
+		c.startErr = err
+	}()
+
+	stderrTail := &tailBuffer{size: stderrTailSize}
+	c.stderrTail = stderrTail
+
+	// If we're doing TLS, then generate the certificate that we'll use
+	// to authenticate ourselves to the plugin.
+	var clientCert *tls.Certificate
+	var clientCertEncoded string
+	if c.config.AutoMTLS {
+		clientCert, err = generateCert()
+		if err != nil {
+			return
+		}
+
+		clientCertEncoded = encodeCert(clientCert)
+	}
 
 	env := []string{
 		fmt.Sprintf("%s=%s", MagicCookieKey, MagicCookieValue),
-		fmt.Sprintf("PACKER_PLUGIN_MIN_PORT=%d", c.config.MinPort),
-		fmt.Sprintf("PACKER_PLUGIN_MAX_PORT=%d", c.config.MaxPort),
+		fmt.Sprintf("%s=%s", ClientCertKey, clientCertEncoded),
+	}
+	if os.Getenv("PACKER_PLUGIN_MIN_PORT") == "" {
+		env = append(env, fmt.Sprintf("PACKER_PLUGIN_MIN_PORT=%d", c.config.MinPort))
+	}
+	if os.Getenv("PACKER_PLUGIN_MAX_PORT") == "" {
+		env = append(env, fmt.Sprintf("PACKER_PLUGIN_MAX_PORT=%d", c.config.MaxPort))
+	}
+	if c.config.BindAddress != "" {
+		env = append(env, fmt.Sprintf(
+			"PACKER_PLUGIN_BIND_ADDRESS=%s", c.config.BindAddress))
+	}
+	if retrying {
+		env = append(env, fmt.Sprintf("%s=1", RetryKey))
 	}
 
 	stdout_r, stdout_w := io.Pipe()
@@ -227,22 +1003,60 @@ func (c *Client) Start() (addr net.Addr, err error) {
 
 	cmd := c.config.Cmd
 	cmd.Env = append(cmd.Env, os.Environ()...)
+	cmd.Env = append(cmd.Env, c.config.Env...)
 	cmd.Env = append(cmd.Env, env...)
+	if c.config.Dir != "" {
+		cmd.Dir = c.config.Dir
+	}
 	cmd.Stdin = os.Stdin
-	cmd.Stderr = stderr_w
+	// The passthrough writer is picked once here, since the goroutine
+	// reading stdout below keeps running long after Start returns.
+	var passthrough io.Writer
+	stderrWriters := []io.Writer{stderrTail, stderr_w}
+	if c.config.PassthroughOutput {
+		passthrough = os.Stderr
+		stderrWriters = append(stderrWriters, passthrough)
+	}
+	cmd.Stderr = io.MultiWriter(stderrWriters...)
 	cmd.Stdout = stdout_w
 
-	log.Printf("Starting plugin: %s %#v", cmd.Path, cmd.Args)
+	releaseSlot, err := acquirePluginSlot(ctx, c.config.Logger, c.config.Name)
+	if err != nil {
+		return
+	}
+
+	exitCh := make(chan struct{})
+	exitErr := new(error)
+	doneLogging := make(chan struct{})
+
+	c.config.Logger.Printf("Starting plugin: %s %#v", cmd.Path, cmd.Args)
+	c.procL.Lock()
 	err = cmd.Start()
+	if err == nil {
+		c.exitCh = exitCh
+		c.exitErr = exitErr
+		c.doneLogging = doneLogging
+	}
+	c.procL.Unlock()
 	if err != nil {
+		releaseSlot()
+		err = startError(c.config.Name, cmd.Path, err)
 		return
 	}
 
-	// Make sure the command is properly cleaned up if there is an error
+	startTime := time.Now()
+	if c.config.Observer != nil {
+		c.config.Observer.OnStart(c.config.Name)
+	}
+
+	// Make sure the command is properly cleaned up if there is an error.
+	// killedOnStart is set so that this isn't taken for a crash.
+	var killedOnStart int32
 	defer func() {
 		r := recover()
 
 		if err != nil || r != nil {
+			atomic.StoreInt32(&killedOnStart, 1)
 			cmd.Process.Kill()
 		}
 
@@ -252,18 +1066,36 @@ func (c *Client) Start() (addr net.Addr, err error) {
 	}()
 
 	// Start goroutine to wait for process to exit
-	exitCh := make(chan struct{})
 	go func() {
 		// Make sure we close the write end of our stderr/stdout so
 		// that the readers send EOF properly.
 		defer stderr_w.Close()
 		defer stdout_w.Close()
 
-		// Wait for the command to end.
-		cmd.Wait()
+		// Wait for the command to end. The result has to be set before
+		// exitCh is closed so that Wait sees it.
+		*exitErr = cmd.Wait()
+		releaseSlot()
+
+		// Keep a report if the plugin crashed rather than being killed
+		if *exitErr != nil && atomic.LoadInt32(&c.killed) == 0 &&
+			atomic.LoadInt32(&killedOnStart) == 0 {
+			c.config.Logger.Printf("%s: plugin crashed: %s", c.config.Name, *exitErr)
+			addCrashReport(CrashReport{
+				Name:     c.config.Name,
+				Pid:      cmd.Process.Pid,
+				ExitCode: cmd.ProcessState.ExitCode(),
+				Stderr:   stderrTail.String(),
+				Time:     time.Now(),
+			})
+		}
+
+		if c.config.Observer != nil {
+			c.config.Observer.OnExit(c.config.Name, *exitErr)
+		}
 
 		// Log and make sure to flush the logs write away
-		log.Printf("%s: plugin process exited\n", cmd.Path)
+		c.config.Logger.Printf("%s: plugin process exited\n", c.config.Name)
 		os.Stderr.Sync()
 
 		// Mark that we exited
@@ -272,11 +1104,30 @@ func (c *Client) Start() (addr net.Addr, err error) {
 		// Set that we exited, which takes a lock
 		c.l.Lock()
 		defer c.l.Unlock()
+
+		// If the plugin asked to be started again, a new process has
+		// already taken this one's place.
+		if c.exitCh != exitCh {
+			return
+		}
+
 		c.exited = true
+		c.exitState = cmd.ProcessState
+
+		// If we didn't kill it, then see if we should restart it
+		if c.config.Restart && atomic.LoadInt32(&c.killed) == 0 {
+			if c.restarts < c.config.MaxRestarts {
+				c.restarts++
+				c.restart = true
+				c.config.Logger.Printf(
+					"%s: plugin exited unexpectedly, restarting on next use (%d/%d)",
+					c.config.Name, c.restarts, c.config.MaxRestarts)
+			}
+		}
 	}()
 
 	// Start goroutine that logs the stderr
-	go c.logStderr(stderr_r)
+	go c.logStderr(stderr_r, doneLogging)
 
 	// Start a goroutine that is going to be reading the lines
 	// out of stdout
@@ -298,10 +1149,19 @@ func (c *Client) Start() (addr net.Addr, err error) {
 	}()
 
 	// Make sure after we exit we read the lines from stdout forever
-	// so they dont' block since it is an io.Pipe
+	// so they dont' block since it is an io.Pipe. Plugins shouldn't
+	// write anything else to stdout, but log it in case they do.
 	defer func() {
 		go func() {
-			for _ = range linesCh {
+			for line := range linesCh {
+				if passthrough != nil {
+					passthrough.Write(line)
+				}
+
+				text := strings.TrimRightFunc(string(line), unicode.IsSpace)
+				if text != "" {
+					c.config.Logger.Printf("%s: stdout: %s", c.config.Name, text)
+				}
 			}
 		}()
 	}()
@@ -310,44 +1170,235 @@ func (c *Client) Start() (addr net.Addr, err error) {
 	timeout := time.After(c.config.StartTimeout)
 
 	// Start looking for the address
-	log.Printf("Waiting for RPC address for: %s", cmd.Path)
+	c.config.Logger.Printf("Waiting for RPC address for: %s", cmd.Path)
 	select {
 	case <-timeout:
-		err = errors.New("timeout while waiting for plugin to start")
+		err = fmt.Errorf("%w (waited %s)", ErrPluginTimeout, c.config.StartTimeout)
 	case <-exitCh:
-		err = errors.New("plugin exited before we could connect")
+		err = ErrPluginExited
+		if tail := c.stderrTail.String(); tail != "" {
+			err = fmt.Errorf("%w. Output from the plugin:\n\n%s", err, tail)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
 	case lineBytes := <-linesCh:
 		// Trim the line and split by "|" in order to get the parts of
 		// the output.
 		line := strings.TrimSpace(string(lineBytes))
-		parts := strings.SplitN(line, "|", 3)
+		if line == RetryDirective {
+			switch {
+			case !c.config.AllowRetry:
+				err = errors.New(
+					"The plugin asked to be started again, but this isn't " +
+						"allowed. Set AllowRetry to allow it.")
+			case retrying:
+				err = errors.New(
+					"The plugin asked to be started again after it was " +
+						"already started again once.")
+			default:
+				err = errPluginRetry
+			}
+			return
+		}
+
+		parts := strings.SplitN(line, "|", 5)
 		if len(parts) < 3 {
-			err = fmt.Errorf("Unrecognized remote plugin message: %s", line)
+			err = fmt.Errorf(
+				"Unrecognized remote plugin message: %s\n\n"+
+					"This usually means that the plugin is either invalid or "+
+					"simply doesn't look like a Packer plugin.", line)
 			return
 		}
 
 		// Test the API version
 		if parts[0] != APIVersion {
 			err = fmt.Errorf("Incompatible API version with plugin. "+
-				"Plugin version: %s, Ours: %s", parts[0], APIVersion)
+				"Plugin version: %s, Ours: %s\n\n"+
+				"Please upgrade the plugin or Packer so that both "+
+				"speak the same version.", parts[0], APIVersion)
 			return
 		}
+		c.apiVersion = parts[0]
 
-		switch parts[1] {
-		case "tcp":
-			addr, err = net.ResolveTCPAddr("tcp", parts[2])
-		case "unix":
-			addr, err = net.ResolveUnixAddr("unix", parts[2])
-		default:
-			err = fmt.Errorf("Unknown address type: %s", parts[1])
+		addr, err = parseAddr(parts[1], parts[2])
+		if err != nil {
+			return
+		}
+
+		// The plugin may also tell us about other named addresses
+		if len(parts) > 4 && parts[4] != "" {
+			c.addresses, err = parseAddresses(parts[4])
+			if err != nil {
+				return
+			}
+		}
+
+		// If we asked for TLS, the plugin must have sent us its
+		// certificate as the last part of the line.
+		if c.config.AutoMTLS {
+			if len(parts) < 4 || parts[3] == "" {
+				err = errors.New(
+					"AutoMTLS was requested but the plugin didn't send " +
+						"a certificate. The plugin may need to be rebuilt " +
+						"with a newer version of Packer.")
+				return
+			}
+
+			var serverPool *x509.CertPool
+			serverPool, err = decodeCertPool(parts[3])
+			if err != nil {
+				err = fmt.Errorf("Error decoding plugin certificate: %s", err)
+				return
+			}
+
+			c.tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{*clientCert},
+				RootCAs:      serverPool,
+				ServerName:   "localhost",
+				MinVersion:   tls.VersionTLS12,
+			}
 		}
 	}
 
 	c.address = addr
+	if err == nil && c.config.Observer != nil {
+		c.config.Observer.OnHandshake(c.config.Name, time.Since(startTime))
+	}
+	if err == nil && c.config.HeartbeatInterval > 0 {
+		go c.heartbeat(cmd.Process, exitCh)
+	}
+
 	return
 }
 
-func (c *Client) logStderr(r io.Reader) {
+// startError adds context to an error from starting the plugin command,
+// since the errors for the most common mistakes are cryptic on their own.
+func startError(name, path string, err error) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf(
+			"error starting plugin %s: %s was not found, is the plugin installed and on PATH? (%w)",
+			name, path, err)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf(
+			"error starting plugin %s: %s is not executable, check its permissions (%w)",
+			name, path, err)
+	default:
+		return fmt.Errorf("error starting plugin %s: %w", name, err)
+	}
+}
+
+// parseAddr parses an address sent by the plugin on the given network.
+func parseAddr(network, address string) (addr net.Addr, err error) {
+	if address == "" {
+		return nil, fmt.Errorf("plugin printed an empty %s address", network)
+	}
+
+	switch network {
+	case "tcp":
+		if _, _, err = net.SplitHostPort(address); err == nil {
+			addr, err = net.ResolveTCPAddr("tcp", address)
+		}
+	case "unix":
+		addr, err = net.ResolveUnixAddr("unix", address)
+	default:
+		return nil, fmt.Errorf("Unknown address type: %s", network)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf(
+			"plugin printed unparseable %s address %q: %s", network, address, err)
+	}
+
+	return addr, nil
+}
+
+// parseAddresses parses the named addresses that the plugin sent on the
+// handshake line, which are encoded by encodeAddresses.
+func parseAddresses(encoded string) (map[string]net.Addr, error) {
+	result := make(map[string]net.Addr)
+	for _, entry := range strings.Split(encoded, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid plugin address: %s", entry)
+		}
+
+		netParts := strings.SplitN(parts[1], ":", 2)
+		if len(netParts) != 2 {
+			return nil, fmt.Errorf("Invalid plugin address: %s", entry)
+		}
+
+		addr, err := parseAddr(netParts[0], netParts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		result[parts[0]] = addr
+	}
+
+	return result, nil
+}
+
+// wrapCmd returns the command made by CommandFunc to run the plugin
+// that the given command would run.
+func (c *Client) wrapCmd(plugin *exec.Cmd) *exec.Cmd {
+	// Args holds the command name first, but may not be set at all
+	var args []string
+	if len(plugin.Args) > 0 {
+		args = plugin.Args[1:]
+	}
+
+	cmd := c.config.CommandFunc(plugin.Path, args)
+	if cmd.Env == nil {
+		cmd.Env = plugin.Env
+	}
+	if cmd.Dir == "" {
+		cmd.Dir = plugin.Dir
+	}
+
+	c.config.Logger.Printf(
+		"%s: running plugin with command: %s %#v", c.config.Name, cmd.Path, cmd.Args)
+	return cmd
+}
+
+// restartCmd returns a new, unstarted command that runs the same plugin
+// in the same way as the given command. An exec.Cmd can't be started more
+// than once, so this is needed to restart a plugin.
+func (c *Client) restartCmd(old *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path:        old.Path,
+		Args:        old.Args,
+		Env:         c.cmdEnv,
+		Dir:         old.Dir,
+		ExtraFiles:  old.ExtraFiles,
+		SysProcAttr: old.SysProcAttr,
+	}
+}
+
+// forget removes the client from the list of managed clients.
+func (c *Client) forget() {
+	managedClientsLock.Lock()
+	defer managedClientsLock.Unlock()
+
+	for i, client := range managedClients {
+		if client == c {
+			managedClients = append(managedClients[:i], managedClients[i+1:]...)
+			return
+		}
+	}
+}
+
+// forgetShared removes this client from sharedClients, if it is there.
+func (c *Client) forgetShared() {
+	sharedClientsLock.Lock()
+	defer sharedClientsLock.Unlock()
+
+	if c.sharedKey != "" && sharedClients[c.sharedKey] == c {
+		delete(sharedClients, c.sharedKey)
+	}
+}
+
+func (c *Client) logStderr(r io.Reader, doneCh chan<- struct{}) {
 	bufR := bufio.NewReader(r)
 	for {
 		line, err := bufR.ReadString('\n')
@@ -355,7 +1406,7 @@ func (c *Client) logStderr(r io.Reader) {
 			c.config.Stderr.Write([]byte(line))
 
 			line = strings.TrimRightFunc(line, unicode.IsSpace)
-			log.Printf("%s: %s", c.config.Cmd.Path, line)
+			c.config.Logger.Printf("%s: %s", c.config.Name, line)
 		}
 
 		if err == io.EOF {
@@ -364,18 +1415,89 @@ func (c *Client) logStderr(r io.Reader) {
 	}
 
 	// Flag that we've completed logging for others
-	close(c.doneLogging)
+	close(doneCh)
+}
+
+// tailBuffer is an io.Writer that keeps only the last size bytes
+// written to it.
+type tailBuffer struct {
+	size int
+	buf  []byte
+	l    sync.Mutex
 }
 
-func (c *Client) packrpcClient() (*packrpc.Client, error) {
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.size {
+		b.buf = b.buf[len(b.buf)-b.size:]
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return string(b.buf)
+}
+
+// StartAndConnect starts the plugin if it isn't started yet and returns
+// an RPC client connected to it. This is the easiest way to talk to a
+// plugin, use Start for more control. It is the same as RPCClient.
+func (c *Client) StartAndConnect() (*packrpc.Client, error) {
+	return c.RPCClient()
+}
+
+// RPCClient returns the RPC client connected to the plugin, starting
+// the plugin and connecting to it if necessary. Connecting is retried a
+// few times in case the plugin isn't quite ready yet. Plugins only
+// accept a single connection, so the client is made once and shared by
+// every component returned from this client. It is closed by Kill.
+func (c *Client) RPCClient() (*packrpc.Client, error) {
 	addr, err := c.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.Dial(addr.Network(), addr.String())
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.procL.Lock()
+	client := c.rpcClient
+	c.procL.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	dial := c.config.Dialer
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	c.procL.Lock()
+	exitCh := c.exitCh
+	c.procL.Unlock()
+
+	var conn net.Conn
+	for attempt := 1; ; attempt++ {
+		conn, err = dial(addr.Network(), addr.String())
+		if err == nil || attempt == dialAttempts {
+			break
+		}
+
+		c.config.Logger.Printf(
+			"%s: error connecting to plugin, retrying: %s", c.config.Name, err)
+		select {
+		case <-time.After(dialRetryInterval):
+		case <-exitCh:
+			return nil, fmt.Errorf("%w: %w", ErrPluginDial, ErrPluginExited)
+		}
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrPluginDial, err)
 	}
 
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
@@ -383,11 +1505,34 @@ func (c *Client) packrpcClient() (*packrpc.Client, error) {
 		tcpConn.SetKeepAlive(true)
 	}
 
-	client, err := packrpc.NewClient(conn)
+	if c.tlsConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig)
+	}
+
+	if c.config.Observer != nil {
+		client, err = packrpc.NewClientWithObserver(conn, &callObserver{
+			name:     c.config.Name,
+			observer: c.config.Observer,
+		})
+	} else {
+		client, err = packrpc.NewClient(conn)
+	}
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
+	if c.config.Secrets != nil {
+		// Not being able to serve the secrets isn't fatal, the plugin
+		// gets an error if it asks for them.
+		if err := client.ServeSecrets(c.config.Secrets); err != nil {
+			c.config.Logger.Printf(
+				"%s: error serving secrets to plugin: %s", c.config.Name, err)
+		}
+	}
+
+	c.procL.Lock()
+	c.rpcClient = client
+	c.procL.Unlock()
 	return client, nil
 }
@@ -2,9 +2,20 @@ package plugin
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	packrpc "github.com/mitchellh/packer/packer/rpc"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,19 +52,1357 @@ func TestClient(t *testing.T) {
 	}
 }
 
+func TestClientAddress(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("addresses")})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if addr.String() != ":1234" {
+		t.Fatalf("bad: %s", addr)
+	}
+
+	addr, err = c.Address("data")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if addr.Network() != "tcp" || addr.String() != "127.0.0.1:1235" {
+		t.Fatalf("bad: %s", addr)
+	}
+
+	if _, err := c.Address("nope"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestNewSharedClient(t *testing.T) {
+	c1 := NewSharedClient("shared", &ClientConfig{Cmd: helperProcess("mock")})
+	defer c1.Kill()
+	c2 := NewSharedClient("shared", &ClientConfig{Cmd: helperProcess("mock")})
+	defer c2.Kill()
+
+	if c1 != c2 {
+		t.Fatal("should be the same client")
+	}
+
+	other := NewSharedClient("other", &ClientConfig{Cmd: helperProcess("mock")})
+	defer other.Kill()
+	if other == c1 {
+		t.Fatal("should be a different client")
+	}
+
+	if _, err := c1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The plugin keeps running until everyone has released it
+	c1.Release()
+	if c1.Exited() {
+		t.Fatal("should not have exited")
+	}
+
+	c2.Release()
+	if !c1.Exited() {
+		t.Fatal("should have exited")
+	}
+
+	// Once killed, a new client is made for the key
+	c3 := NewSharedClient("shared", &ClientConfig{Cmd: helperProcess("mock")})
+	defer c3.Kill()
+	if c3 == c1 {
+		t.Fatal("should be a new client")
+	}
+}
+
+func TestNewSharedClient_duringStart(t *testing.T) {
+	c1 := NewSharedClient("slow", &ClientConfig{Cmd: helperProcess("start-timeout")})
+	defer c1.Kill()
+
+	go c1.Start()
+
+	// Wait for Start to be waiting on the plugin's address
+	for {
+		c1.procL.Lock()
+		started := c1.config.Cmd.Process != nil
+		c1.procL.Unlock()
+		if started {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Looking up the client doesn't wait for Start
+	sharedCh := make(chan *Client, 1)
+	go func() {
+		sharedCh <- NewSharedClient("slow", &ClientConfig{Cmd: helperProcess("start-timeout")})
+	}()
+
+	select {
+	case c2 := <-sharedCh:
+		if c2 != c1 {
+			t.Fatal("should be the same client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewSharedClient should return")
+	}
+}
+
+func TestClientStartWithInfo(t *testing.T) {
+	process := helperProcess("mock")
+	c := NewClient(&ClientConfig{Cmd: process})
+	defer c.Kill()
+
+	info, err := c.StartWithInfo()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &StartInfo{
+		Address:         ":1234",
+		Network:         "tcp",
+		PID:             process.Process.Pid,
+		ProtocolVersion: APIVersion,
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestClient_unix(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock-unix")})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err should be nil, got %s", err)
+	}
+
+	if addr.Network() != "unix" {
+		t.Fatalf("bad: %#v", addr)
+	}
+
+	if addr.String() != "/tmp/packer-plugin.sock" {
+		t.Fatalf("bad: %#v", addr)
+	}
+}
+
+func TestClient_autoMTLS(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:      helperProcess("builder"),
+		AutoMTLS: true,
+	})
+	defer c.Kill()
+
+	b, err := c.Builder()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := b.Prepare(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestClient_autoMTLSUnsupported(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:      helperProcess("mock"),
+		AutoMTLS: true,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCleanupClients(t *testing.T) {
+	defer func() { Killed = false }()
+
+	process := helperProcess("mock")
+	c := NewClient(&ClientConfig{Cmd: process, Managed: true})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	CleanupClients()
+	if !c.Exited() {
+		t.Fatal("should say client has exited")
+	}
+
+	if len(managedClients) != 0 {
+		t.Fatalf("bad: %#v", managedClients)
+	}
+
+	// Calling it again should be fine
+	CleanupClients()
+}
+
+func TestCleanupClients_concurrency(t *testing.T) {
+	defer func() { Killed = false }()
+
+	old := CleanupConcurrency
+	CleanupConcurrency = 1
+	defer func() { CleanupConcurrency = old }()
+
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = NewClient(&ClientConfig{Cmd: helperProcess("mock"), Managed: true})
+		defer clients[i].Kill()
+
+		if _, err := clients[i].Start(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	CleanupClients()
+	for i, c := range clients {
+		if !c.Exited() {
+			t.Fatalf("client %d should say it has exited", i)
+		}
+	}
+}
+
+func TestCleanupClientsContext(t *testing.T) {
+	defer func() { Killed = false }()
+
+	// The child keeps stderr open, so the client never finishes logging
+	c := NewClient(&ClientConfig{Cmd: helperProcess("stderr-hold"), Managed: true})
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	doneCh := make(chan struct{})
+	go func() {
+		CleanupClientsContext(ctx)
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup should stop at the deadline")
+	}
+}
+
+func TestClientKill_forgetsManaged(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock"), Managed: true})
+	defer c.Kill()
+
+	managedClientsLock.Lock()
+	count := len(managedClients)
+	managedClientsLock.Unlock()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	managedClientsLock.Lock()
+	defer managedClientsLock.Unlock()
+	if len(managedClients) != count-1 {
+		t.Fatalf("bad: %d", len(managedClients))
+	}
+
+	for _, m := range managedClients {
+		if m == c {
+			t.Fatal("client should not be managed")
+		}
+	}
+}
+
+func TestNewClient_managedConcurrent(t *testing.T) {
+	defer func() { Killed = false }()
+	defer CleanupClients()
+
+	var wg sync.WaitGroup
+	clients := make([]*Client, 50)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i] = NewClient(&ClientConfig{
+				Cmd:     helperProcess("mock"),
+				Managed: true,
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	managedClientsLock.Lock()
+	defer managedClientsLock.Unlock()
+
+	if len(managedClients) != len(clients) {
+		t.Fatalf("bad: %d", len(managedClients))
+	}
+
+	for _, c := range clients {
+		found := false
+		for _, m := range managedClients {
+			if c == m {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("client not managed: %#v", c)
+		}
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("builder")})
+	defer c.Kill()
+
+	// Ping should work alongside components on the same connection
+	if _, err := c.Builder(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestClientPing_noServer(t *testing.T) {
+	oldTimeout := pingTimeout
+	defer func() { pingTimeout = oldTimeout }()
+	pingTimeout = 50 * time.Millisecond
+
+	// The mock plugin never serves anything, so the ping can't succeed.
+	// Shorten the timeout in case something else is listening there.
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	defer c.Kill()
+
+	if err := c.Ping(); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestClientRPCClient(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("builder")})
+	defer c.Kill()
+
+	client, err := c.RPCClient()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The connection is made only once
+	client2, err := c.RPCClient()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if client2 != client {
+		t.Fatal("should return the same client")
+	}
+
+	// Killing closes the connection
+	c.Kill()
+	if err := client.Ping(); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestClient_dialer(t *testing.T) {
+	var dialed []string
+	c := NewClient(&ClientConfig{
+		Cmd: helperProcess("builder"),
+		Dialer: func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			return net.Dial(network, addr)
+		},
+	})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{addr.Network() + " " + addr.String()}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Fatalf("bad: %#v", dialed)
+	}
+}
+
+func TestClientStartAndConnect(t *testing.T) {
+	// The first tries to connect fail, as if the plugin weren't ready
+	attempts := 0
+	c := NewClient(&ClientConfig{
+		Cmd: helperProcess("builder"),
+		Dialer: func(network, addr string) (net.Conn, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("not ready")
+			}
+
+			return net.Dial(network, addr)
+		},
+	})
+	defer c.Kill()
+
+	client, err := c.StartAndConnect()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("bad: %d", attempts)
+	}
+
+	// The same client is returned every time
+	if again, err := c.StartAndConnect(); err != nil || again != client {
+		t.Fatalf("bad: %#v %s", again, err)
+	}
+}
+
+func TestClientStartAndConnect_slowAccept(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("slow-accept")})
+	defer c.Kill()
+
+	client, err := c.StartAndConnect()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The connection waits until the plugin accepts it
+	if _, err := client.Builder().Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestClient_dialError(t *testing.T) {
+	// The mock plugin says it is on a socket that doesn't exist
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock-unix")})
+	defer c.Kill()
+
+	_, err := c.Builder()
+	if !errors.Is(err, ErrPluginDial) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClient_dialExited(t *testing.T) {
+	defer func(old int) { dialAttempts = old }(dialAttempts)
+	dialAttempts = 100
+
+	// The mock plugin exits while we are still trying to connect
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock-unix-exit")})
+	defer c.Kill()
+
+	_, err := c.Builder()
+	if !errors.Is(err, ErrPluginDial) {
+		t.Fatalf("bad: %s", err)
+	}
+	if !errors.Is(err, ErrPluginExited) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClient_heartbeatOldPlugin(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:                       helperProcess("no-control"),
+		Name:                      "heartbeat-old",
+		HeartbeatInterval:         20 * time.Millisecond,
+		HeartbeatFailureThreshold: 1,
+	})
+	defer c.Kill()
+
+	// The plugin can't be pinged, but it is still healthy
+	if err := c.Ping(); err != packrpc.ErrPingUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if c.Exited() {
+		t.Fatal("should not be exited")
+	}
+	if _, ok := crashReport("heartbeat-old"); ok {
+		t.Fatal("should not have a crash report")
+	}
+
+	// The heartbeats didn't break the connection
+	if err := c.Ping(); err != packrpc.ErrPingUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClientKind(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock"), Kind: KindProvisioner})
+	if c.Kind() != KindProvisioner {
+		t.Fatalf("bad: %s", c.Kind())
+	}
+
+	c = NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	if c.Kind() != KindUnknown {
+		t.Fatalf("bad: %s", c.Kind())
+	}
+}
+
+type testSecrets map[string]string
+
+func (s testSecrets) Secrets() (map[string]string, error) {
+	return s, nil
+}
+
+func TestClientSecrets(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("secrets"),
+		Secrets: testSecrets{"token": "hunter2"},
+	})
+	defer c.Kill()
+
+	b, err := c.Builder()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	warns, err := b.Prepare(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(warns) != 1 || warns[0] != "hunter2" {
+		t.Fatalf("bad: %#v", warns)
+	}
+}
+
+func TestClientSecrets_none(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("secrets")})
+	defer c.Kill()
+
+	b, err := c.Builder()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err = b.Prepare(nil)
+	if err == nil || err.Error() != packrpc.ErrNoSecrets.Error() {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClientExitStatus(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("exit-status")})
+	defer c.Kill()
+
+	if _, err := c.ExitStatus(); err == nil {
+		t.Fatal("should have error before starting")
+	}
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status, err := c.ExitStatus()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if status != 42 {
+		t.Fatalf("bad: %d", status)
+	}
+}
+
+func TestClientWait(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("exit-status")})
+	defer c.Kill()
+
+	if err := c.Wait(); err == nil {
+		t.Fatal("should have error before starting")
+	}
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errCh <- c.Wait()
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				t.Fatalf("err: %#v", err)
+			}
+			if exitErr.ExitCode() != 42 {
+				t.Fatalf("bad: %d", exitErr.ExitCode())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait should return when the plugin exits")
+		}
+	}
+}
+
+// This is meant to be run with -race, to check that the exit state is
+// safe to read while the plugin is being killed.
+func TestClientKill_exitedConcurrent(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	doneCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-doneCh:
+					return
+				default:
+					c.Exited()
+				}
+			}
+		}()
+	}
+
+	c.Kill()
+	close(doneCh)
+	wg.Wait()
+
+	if !c.Exited() {
+		t.Fatal("should say client has exited")
+	}
+}
+
+// testObserver records the events it is told about.
+type testObserver struct {
+	l      sync.Mutex
+	events []string
+}
+
+func (o *testObserver) record(event string) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *testObserver) OnStart(name string) {
+	o.record("start " + name)
+}
+
+func (o *testObserver) OnHandshake(name string, d time.Duration) {
+	o.record("handshake " + name)
+}
+
+func (o *testObserver) OnExit(name string, err error) {
+	o.record("exit " + name)
+}
+
+func (o *testObserver) OnCall(name, method string, d time.Duration, err error) {
+	o.record("call " + name + " " + method)
+}
+
+func TestClient_observer(t *testing.T) {
+	o := new(testObserver)
+	c := NewClient(&ClientConfig{
+		Cmd:      helperProcess("builder"),
+		Name:     "foo",
+		Observer: o,
+	})
+	defer c.Kill()
+
+	builder, err := c.Builder()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := builder.Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	o.l.Lock()
+	defer o.l.Unlock()
+	expected := []string{
+		"start foo",
+		"handshake foo",
+		"call foo Builder.Prepare",
+		"exit foo",
+	}
+	if !reflect.DeepEqual(o.events, expected) {
+		t.Fatalf("bad: %#v", o.events)
+	}
+}
+
+// killReturns calls Kill and fails the test if it doesn't return.
+func killReturns(t *testing.T, c *Client) {
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		c.Kill()
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kill should return")
+	}
+}
+
+func TestClientKill_neverStarted(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	killReturns(t, c)
+
+	if c.Exited() {
+		t.Fatal("should not say client has exited")
+	}
+}
+
+func TestClientKill_startFailed(t *testing.T) {
+	// A command that was already started gets a process without the
+	// client ever waiting for it or logging its output.
+	process := helperProcess("start-timeout")
+	if err := process.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer process.Wait()
+
+	c := NewClient(&ClientConfig{Cmd: process})
+	if _, err := c.Start(); err == nil {
+		t.Fatal("should have error")
+	}
+
+	killReturns(t, c)
+}
+
+func TestClientKill_running(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	killReturns(t, c)
+
+	if !c.Exited() {
+		t.Fatal("should say client has exited")
+	}
+}
+
+func TestClientKill_sigterm(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:    helperProcess("sigterm"),
+		Stderr: stderr,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	status, err := c.ExitStatus()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if status != 0 {
+		t.Fatalf("bad: %d", status)
+	}
+
+	if !strings.Contains(stderr.String(), "got SIGTERM\n") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClientKill_drain(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:          helperProcess("builder"),
+		DrainTimeout: 5 * time.Second,
+	})
+	defer c.Kill()
+
+	if _, err := c.Builder(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if !c.Drained() {
+		t.Fatal("should be drained")
+	}
+}
+
+func TestClientKill_drainOldPlugin(t *testing.T) {
+	logOut := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:          helperProcess("no-control"),
+		DrainTimeout: 5 * time.Second,
+		Logger:       log.New(logOut, "", 0),
+	})
+	defer c.Kill()
+
+	if _, err := c.RPCClient(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if c.Drained() {
+		t.Fatal("should not be drained")
+	}
+	if strings.Contains(logOut.String(), "error draining") {
+		t.Fatalf("bad log data: '%s'", logOut.String())
+	}
+}
+
+func TestClientKill_drainDuringStart(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:          helperProcess("start-timeout"),
+		DrainTimeout: 5 * time.Second,
+	})
+	defer c.Kill()
+
+	startCh := make(chan error, 1)
+	go func() {
+		_, err := c.Start()
+		startCh <- err
+	}()
+
+	// Wait for Start to be waiting on the plugin's address
+	for {
+		c.procL.Lock()
+		started := c.config.Cmd.Process != nil
+		c.procL.Unlock()
+		if started {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Kill mustn't wait for Start to give up before draining
+	killReturns(t, c)
+
+	if c.Drained() {
+		t.Fatal("should not be drained")
+	}
+	if err := <-startCh; err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestClientKill_noDrain(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("builder")})
+	defer c.Kill()
+
+	if _, err := c.Builder(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if c.Drained() {
+		t.Fatal("should not be drained")
+	}
+}
+
+func TestClientKill_timeout(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:         helperProcess("sigterm-ignore"),
+		KillTimeout: 50 * time.Millisecond,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if !c.Exited() {
+		t.Fatal("should say client has exited")
+	}
+}
+
+func TestClientKillContext(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("stderr-hold")})
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The child holds stderr open, so logging won't finish in time
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := c.KillContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestClientStart_restart(t *testing.T) {
+	process := helperProcess("exit-status")
+	c := NewClient(&ClientConfig{
+		Cmd:         process,
+		Restart:     true,
+		MaxRestarts: 1,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Starting again should run a new process
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	restarted := c.config.Cmd
+	if restarted == process {
+		t.Fatal("should have started a new process")
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// We've used up our restarts, so this should do nothing
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if c.config.Cmd != restarted {
+		t.Fatal("should not have restarted again")
+	}
+}
+
+// closeConn is a net.Conn that records whether it was closed.
+type closeConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *closeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func TestClientStart_restartClosesConn(t *testing.T) {
+	var conns []*closeConn
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("builder"),
+		Restart: true,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			conns = append(conns, &closeConn{Conn: conn})
+			return conns[len(conns)-1], nil
+		},
+	})
+	defer c.Kill()
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The plugin exits on its own, without being killed by the client
+	c.config.Cmd.Process.Kill()
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The connection to the old process is closed
+	if len(conns) != 2 {
+		t.Fatalf("bad: %d", len(conns))
+	}
+	if atomic.LoadInt32(&conns[0].closed) != 1 {
+		t.Fatal("old connection should be closed")
+	}
+}
+
+func TestClientStart_noRestartAfterKill(t *testing.T) {
+	process := helperProcess("mock")
+	c := NewClient(&ClientConfig{Cmd: process, Restart: true})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if c.config.Cmd != process {
+		t.Fatal("should not have restarted")
+	}
+}
+
+func TestClientStart_multiple(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	addr2, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if addr.String() != addr2.String() {
+		t.Fatalf("bad: %s != %s", addr, addr2)
+	}
+}
+
+func TestClientStart_multipleFailed(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: exec.Command("i-should-not-exist")})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	_, err2 := c.Start()
+	if err2 != err {
+		t.Fatalf("bad: %#v", err2)
+	}
+}
+
 func TestClientStart_badVersion(t *testing.T) {
 	config := &ClientConfig{
 		Cmd:          helperProcess("bad-version"),
 		StartTimeout: 50 * time.Millisecond,
 	}
 
-	c := NewClient(config)
+	c := NewClient(config)
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+
+	expected := fmt.Sprintf(
+		"Plugin version: %s1, Ours: %s", APIVersion, APIVersion)
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_portRange(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("port-range"),
+		MinPort: 40000,
+		MaxPort: 41000,
+		Stderr:  stderr,
+	})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if addr.String() != ":40000" {
+		t.Fatalf("bad: %s", addr)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(stderr.String(), "max port: 41000\n") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClientStart_portRangeEnv(t *testing.T) {
+	// The environment of the host wins over the config
+	t.Setenv("PACKER_PLUGIN_MIN_PORT", "42000")
+
+	stderr := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:     helperProcess("port-range"),
+		MinPort: 40000,
+		MaxPort: 41000,
+		Stderr:  stderr,
+	})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if addr.String() != ":42000" {
+		t.Fatalf("bad: %s", addr)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(stderr.String(), "max port: 41000\n") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClientStart_envDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stderr := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:    helperProcess("env"),
+		Env:    []string{"PACKER_TEST_ENV=foo"},
+		Dir:    dir,
+		Stderr: stderr,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(stderr.String(), "env: foo\n") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+
+	if !strings.Contains(stderr.String(), fmt.Sprintf("dir: %s\n", dir)) {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClientStart_commandFunc(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd: helperProcess("env"),
+		CommandFunc: func(path string, args []string) *exec.Cmd {
+			args = append([]string{"PACKER_TEST_ENV=wrapped", path}, args...)
+			return exec.Command("env", args...)
+		},
+		Stderr: stderr,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(stderr.String(), "env: wrapped\n") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClientWrapCmd_noArgs(t *testing.T) {
+	var gotPath string
+	var gotArgs []string
+	c := NewClient(&ClientConfig{
+		Cmd: &exec.Cmd{Path: "/bin/true"},
+		CommandFunc: func(path string, args []string) *exec.Cmd {
+			gotPath, gotArgs = path, args
+			return exec.Command(path)
+		},
+	})
+
+	cmd := c.wrapCmd(c.config.Cmd)
+	if cmd.Path != "/bin/true" {
+		t.Fatalf("bad: %s", cmd.Path)
+	}
+	if gotPath != "/bin/true" {
+		t.Fatalf("bad: %s", gotPath)
+	}
+	if gotArgs != nil {
+		t.Fatalf("bad: %#v", gotArgs)
+	}
+}
+
+func TestClientStart_notFound(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: exec.Command("i-should-not-exist")})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("bad: %s", err)
+	}
+	if !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_notExecutable(t *testing.T) {
+	f, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	c := NewClient(&ClientConfig{Cmd: exec.Command(f.Name())})
+	defer c.Kill()
+
+	_, err = c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("bad: %s", err)
+	}
+	if !strings.Contains(err.Error(), "not executable") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_retry(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("retry"), AllowRetry: true})
+	defer c.Kill()
+
+	addr, err := c.Start()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if addr.String() != ":1234" {
+		t.Fatalf("bad: %s", addr)
+	}
+	if c.Exited() {
+		t.Fatal("should not be exited")
+	}
+}
+
+func TestClientStart_retryOnce(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("retry-always"), AllowRetry: true})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if !strings.Contains(err.Error(), "already started again") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_retryNotAllowed(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("retry")})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+	if !strings.Contains(err.Error(), "AllowRetry") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_badAddress(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("bad-address")})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+
+	if !strings.Contains(err.Error(), `"not-an-address"`) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_invalidAddress(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("invalid-rpc-address")})
+	defer c.Kill()
+
+	_, err := c.Start()
+	if err == nil {
+		t.Fatal("err should not be nil")
+	}
+
+	if !strings.Contains(err.Error(), "Packer plugin") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestClientStart_exitStderr(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("stderr-exit")})
 	defer c.Kill()
 
 	_, err := c.Start()
 	if err == nil {
 		t.Fatal("err should not be nil")
 	}
+
+	if !errors.Is(err, ErrPluginExited) {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !strings.Contains(err.Error(), "something went wrong") {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !strings.Contains(c.Stderr(), "something went wrong") {
+		t.Fatalf("bad: %s", c.Stderr())
+	}
 }
 
 func TestClient_Start_Timeout(t *testing.T) {
@@ -69,6 +1418,79 @@ func TestClient_Start_Timeout(t *testing.T) {
 	if err == nil {
 		t.Fatal("err should not be nil")
 	}
+
+	if !errors.Is(err, ErrPluginTimeout) {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !strings.Contains(err.Error(), "50ms") {
+		t.Fatalf("error should mention the timeout: %s", err)
+	}
+}
+
+func TestClientStartContext_cancel(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("start-timeout")})
+	defer c.Kill()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := c.StartContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("bad: %#v", err)
+	}
+
+	c.Kill()
+
+	if !c.Exited() {
+		t.Fatal("should say client has exited")
+	}
+}
+
+func TestClientStart_maxConcurrent(t *testing.T) {
+	SetMaxConcurrentPlugins(1)
+	defer SetMaxConcurrentPlugins(0)
+
+	c1 := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	defer c1.Kill()
+	if _, err := c1.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A second plugin can't start while the first is running
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c2 := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	defer c2.Kill()
+	if _, err := c2.StartContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	c3 := NewClient(&ClientConfig{Cmd: helperProcess("mock")})
+	defer c3.Kill()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c3.Start()
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("should not start yet: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once the first exits, the waiting one can start
+	c1.Kill()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin should start once a slot is free")
+	}
 }
 
 func TestClient_Stderr(t *testing.T) {
@@ -88,6 +1510,9 @@ func TestClient_Stderr(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 
+	// Kill waits for all of the stderr to be logged
+	c.Kill()
+
 	if !strings.Contains(stderr.String(), "HELLO\n") {
 		t.Fatalf("bad log data: '%s'", stderr.String())
 	}
@@ -95,6 +1520,120 @@ func TestClient_Stderr(t *testing.T) {
 	if !strings.Contains(stderr.String(), "WORLD\n") {
 		t.Fatalf("bad log data: '%s'", stderr.String())
 	}
+
+	// The last line has no newline and is written right before exit
+	if !strings.HasSuffix(stderr.String(), "BYE") {
+		t.Fatalf("bad log data: '%s'", stderr.String())
+	}
+}
+
+func TestClient_PassthroughOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	oldStderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = oldStderr }()
+
+	c := NewClient(&ClientConfig{
+		Cmd:               helperProcess("stderr"),
+		PassthroughOutput: true,
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Kill()
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(string(data), "HELLO\n") || !strings.HasSuffix(string(data), "BYE") {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestClient_Logger(t *testing.T) {
+	logOut := new(bytes.Buffer)
+	process := helperProcess("stderr")
+	c := NewClient(&ClientConfig{
+		Cmd:    process,
+		Logger: log.New(logOut, "", 0),
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Wait for the rest of stderr to be logged
+	c.Kill()
+
+	expected := filepath.Base(process.Path) + ": "
+	if !strings.Contains(logOut.String(), expected) {
+		t.Fatalf("bad log data: '%s'", logOut.String())
+	}
+
+	if !strings.Contains(logOut.String(), "WORLD\n") {
+		t.Fatalf("bad log data: '%s'", logOut.String())
+	}
+}
+
+func TestClient_LoggerName(t *testing.T) {
+	logOut := new(bytes.Buffer)
+	c := NewClient(&ClientConfig{
+		Cmd:    helperProcess("stderr"),
+		Name:   "foo",
+		Logger: log.New(logOut, "", 0),
+	})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for !c.Exited() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Wait for the rest of stderr to be logged
+	c.Kill()
+
+	if !strings.Contains(logOut.String(), "foo: plugin process exited\n") {
+		t.Fatalf("bad log data: '%s'", logOut.String())
+	}
+}
+
+func TestClient_stdoutAfterAddress(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("stdout")})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The plugin can only exit if its stdout keeps being read
+	for i := 0; !c.Exited(); i++ {
+		if i > 500 {
+			t.Fatal("plugin should exit")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 func TestClient_Stdin(t *testing.T) {
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package plugin
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClient_heartbeat(t *testing.T) {
+	c := NewClient(&ClientConfig{
+		Cmd:                       helperProcess("builder"),
+		Name:                      "heartbeat",
+		HeartbeatInterval:         50 * time.Millisecond,
+		HeartbeatFailureThreshold: 2,
+	})
+	defer c.Kill()
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The plugin is fine while it keeps responding
+	time.Sleep(200 * time.Millisecond)
+	if c.Exited() {
+		t.Fatal("should not be exited")
+	}
+
+	// Stop the plugin so that it can't respond anymore
+	if err := c.config.Cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for i := 0; i < 500 && !c.Exited(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.Exited() {
+		t.Fatal("plugin should be killed")
+	}
+	if _, ok := crashReport("heartbeat"); !ok {
+		t.Fatal("should have a crash report")
+	}
+}
@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCrashReports is how many crash reports are kept. Older ones are
+// dropped first.
+const maxCrashReports = 32
+
+// crashReports are the most recent crash reports, oldest first. Access
+// to it must be guarded by crashReportsLock.
+var crashReports []CrashReport
+var crashReportsLock sync.Mutex
+
+// CrashReport describes a plugin that exited with an error without
+// being killed, so that a host can show which plugin crashed and why.
+type CrashReport struct {
+	// Name is the name of the plugin, as in ClientConfig.
+	Name string
+
+	// Pid is the process ID the plugin had.
+	Pid int
+
+	// ExitCode is the exit code of the plugin, or -1 if it was ended
+	// by a signal.
+	ExitCode int
+
+	// Stderr is the end of what the plugin wrote to stderr.
+	Stderr string
+
+	// Time is when the plugin exited.
+	Time time.Time
+}
+
+// CrashReports returns the reports for the plugins that have crashed,
+// oldest first. Only the most recent reports are kept.
+func CrashReports() []CrashReport {
+	crashReportsLock.Lock()
+	defer crashReportsLock.Unlock()
+
+	result := make([]CrashReport, len(crashReports))
+	copy(result, crashReports)
+	return result
+}
+
+// addCrashReport records a crash report, dropping the oldest one if
+// there are too many.
+func addCrashReport(r CrashReport) {
+	crashReportsLock.Lock()
+	defer crashReportsLock.Unlock()
+
+	crashReports = append(crashReports, r)
+	if len(crashReports) > maxCrashReports {
+		crashReports = crashReports[len(crashReports)-maxCrashReports:]
+	}
+}
@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+// crashReport returns the last crash report for the named plugin.
+func crashReport(name string) (CrashReport, bool) {
+	reports := CrashReports()
+	for i := len(reports) - 1; i >= 0; i-- {
+		if reports[i].Name == name {
+			return reports[i], true
+		}
+	}
+
+	return CrashReport{}, false
+}
+
+func TestCrashReports(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("crash"), Name: "crash-report"})
+	defer c.Kill()
+
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := c.Wait(); err == nil {
+		t.Fatal("should have error")
+	}
+
+	r, ok := crashReport("crash-report")
+	if !ok {
+		t.Fatal("should have a crash report")
+	}
+	if r.ExitCode != 2 {
+		t.Fatalf("bad: %d", r.ExitCode)
+	}
+	if r.Pid == 0 {
+		t.Fatal("should have a pid")
+	}
+	if !strings.Contains(r.Stderr, "something went wrong") {
+		t.Fatalf("bad: %q", r.Stderr)
+	}
+	if r.Time.IsZero() {
+		t.Fatal("should have a time")
+	}
+}
+
+func TestCrashReports_killed(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("mock"), Name: "crash-report-killed"})
+	if _, err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c.Kill()
+
+	if _, ok := crashReport("crash-report-killed"); ok {
+		t.Fatal("killed plugins should not be reported")
+	}
+}
+
+func TestAddCrashReport_max(t *testing.T) {
+	for i := 0; i < maxCrashReports+1; i++ {
+		addCrashReport(CrashReport{Name: "crash-report-max", Pid: i})
+	}
+
+	reports := CrashReports()
+	if len(reports) != maxCrashReports {
+		t.Fatalf("bad: %d", len(reports))
+	}
+	if r := reports[len(reports)-1]; r.Pid != maxCrashReports {
+		t.Fatalf("bad: %#v", r)
+	}
+}
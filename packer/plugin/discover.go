@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Discover finds the plugin binaries in dir whose file names match glob,
+// such as "packer-builder-*", and returns commands that run them, keyed
+// by component name. The component name is the part of the file name
+// matched by the "*" in glob, so with the glob above the plugin
+// "packer-builder-amazon-ebs" is named "amazon-ebs". Files that aren't
+// executable or can't be read, such as broken symlinks, are skipped.
+func Discover(dir, glob string) (map[string]*exec.Cmd, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return nil, err
+	}
+
+	// The part of glob around the "*" is trimmed to get the name
+	prefix, suffix := glob, ""
+	if idx := strings.Index(glob, "*"); idx > -1 {
+		prefix, suffix = glob[:idx], glob[idx+1:]
+	}
+
+	result := make(map[string]*exec.Cmd)
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("[WARN] Skipping plugin %s: %s", path, err)
+			continue
+		}
+
+		if !isExecutable(info) {
+			continue
+		}
+
+		name := filepath.Base(path)
+		if runtime.GOOS == "windows" {
+			name = strings.TrimSuffix(name, ".exe")
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+
+		result[name] = exec.Command(path)
+	}
+
+	return result, nil
+}
+
+func isExecutable(info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+
+	// Windows doesn't have an executable bit
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	return info.Mode().Perm()&0111 != 0
+}
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]os.FileMode{
+		"packer-builder-foo":     0755,
+		"packer-builder-bar":     0644,
+		"packer-provisioner-baz": 0755,
+	}
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, mode); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	cmds, err := Discover(dir, "packer-builder-*")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(cmds) != 1 {
+		t.Fatalf("bad: %#v", cmds)
+	}
+
+	cmd, ok := cmds["foo"]
+	if !ok {
+		t.Fatalf("bad: %#v", cmds)
+	}
+	if cmd.Path != filepath.Join(dir, "packer-builder-foo") {
+		t.Fatalf("bad: %s", cmd.Path)
+	}
+}
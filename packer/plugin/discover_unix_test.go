@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscover_brokenSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "packer-builder-foo")
+	if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The symlink points to a file that doesn't exist, so it can't be
+	// stat'ed
+	broken := filepath.Join(dir, "packer-builder-broken")
+	if err := os.Symlink(filepath.Join(dir, "missing"), broken); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cmds, err := Discover(dir, "packer-builder-*")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(cmds) != 1 {
+		t.Fatalf("bad: %#v", cmds)
+	}
+	if _, ok := cmds["foo"]; !ok {
+		t.Fatalf("bad: %#v", cmds)
+	}
+}
@@ -0,0 +1,32 @@
+package plugin
+
+// Kind is the kind of component that a plugin provides. It is only
+// bookkeeping for the host, for example to group its plugins, and isn't
+// checked against what the plugin actually serves.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindBuilder
+	KindCommand
+	KindHook
+	KindPostProcessor
+	KindProvisioner
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindBuilder:
+		return "builder"
+	case KindCommand:
+		return "command"
+	case KindHook:
+		return "hook"
+	case KindPostProcessor:
+		return "post-processor"
+	case KindProvisioner:
+		return "provisioner"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,20 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestKindString(t *testing.T) {
+	cases := map[Kind]string{
+		KindUnknown:       "unknown",
+		KindBuilder:       "builder",
+		KindPostProcessor: "post-processor",
+		Kind(42):          "unknown",
+	}
+
+	for k, expected := range cases {
+		if k.String() != expected {
+			t.Fatalf("bad: %d %s", k, k)
+		}
+	}
+}
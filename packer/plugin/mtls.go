@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"time"
+)
+
+// ClientCertKey is the environment variable the client uses to hand its
+// certificate to the plugin when AutoMTLS is enabled. If it is empty,
+// the plugin serves plain RPC.
+const ClientCertKey = "PACKER_PLUGIN_CLIENT_CERT"
+
+// generateCert creates a new self-signed certificate and key for one
+// end of a plugin connection. A new certificate is made for every plugin
+// launch, so it only needs to be valid for as long as the handshake takes.
+func generateCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "localhost",
+			Organization: []string{"Packer"},
+		},
+		DNSNames:  []string{"localhost"},
+		NotBefore: now.Add(-30 * time.Second),
+		NotAfter:  now.Add(24 * time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth,
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// encodeCert encodes the public part of a certificate so that it can be
+// passed in an environment variable or on the handshake line.
+func encodeCert(cert *tls.Certificate) string {
+	return base64.StdEncoding.EncodeToString(cert.Certificate[0])
+}
+
+// decodeCertPool decodes a certificate encoded with encodeCert and
+// returns a pool containing only that certificate, so that the other
+// end can be verified against exactly that certificate.
+func decodeCertPool(encoded string) (*x509.CertPool, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool, nil
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"time"
+)
+
+// Observer is told about the lifecycle of a plugin and the RPC calls made
+// to it, for example to record them as metrics. Set it with the Observer
+// field of ClientConfig. The methods are called from the client's own
+// goroutines, so they must be safe for concurrent use and not block.
+type Observer interface {
+	// OnStart is called once the plugin process has been started.
+	OnStart(name string)
+
+	// OnHandshake is called once the plugin has told us its address,
+	// with how long that took after the process was started.
+	OnHandshake(name string, d time.Duration)
+
+	// OnExit is called when the plugin process exits, with the error
+	// from waiting on it. This is nil if it exited cleanly, and not nil
+	// if it crashed or was killed.
+	OnExit(name string, err error)
+
+	// OnCall is called when an RPC call to the plugin returns, with how
+	// long it took and the error the plugin returned, if any.
+	OnCall(name, method string, d time.Duration, err error)
+}
+
+// callObserver passes the calls made on a plugin's RPC connection on to
+// the Observer of the plugin's client.
+type callObserver struct {
+	name     string
+	observer Observer
+}
+
+func (o *callObserver) OnCall(method string, d time.Duration, err error) {
+	o.observer.OnCall(o.name, method, d, err)
+}
@@ -3,13 +3,33 @@ package plugin
 import (
 	"fmt"
 	"github.com/mitchellh/packer/packer"
+	packrpc "github.com/mitchellh/packer/packer/rpc"
 	"log"
+	"net"
+	"net/rpc"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
 	"testing"
 	"time"
 )
 
+// secretsBuilder is a builder that warns with the secrets it gets from
+// the host, so that tests can check that they got through.
+type secretsBuilder struct {
+	packer.MockBuilder
+}
+
+func (b *secretsBuilder) Prepare(config ...interface{}) ([]string, error) {
+	secrets, err := Secrets()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{secrets["token"]}, nil
+}
+
 func helperProcess(s ...string) *exec.Cmd {
 	cs := []string{"-test.run=TestHelperProcess", "--"}
 	cs = append(cs, s...)
@@ -50,6 +70,11 @@ func TestHelperProcess(*testing.T) {
 
 	cmd, args := args[0], args[1:]
 	switch cmd {
+	case "addresses":
+		fmt.Printf("%s|tcp|:1234||data=tcp:127.0.0.1:1235\n", APIVersion)
+	case "bad-address":
+		fmt.Printf("%s|tcp|not-an-address\n", APIVersion)
+		<-make(chan int)
 	case "bad-version":
 		fmt.Printf("%s1|tcp|:1234\n", APIVersion)
 		<-make(chan int)
@@ -69,6 +94,18 @@ func TestHelperProcess(*testing.T) {
 		}
 		server.RegisterCommand(new(helperCommand))
 		server.Serve()
+	case "crash":
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		log.Println("panic: something went wrong")
+		os.Exit(2)
+	case "env":
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		wd, _ := os.Getwd()
+		log.Printf("env: %s", os.Getenv("PACKER_TEST_ENV"))
+		log.Printf("dir: %s", wd)
+	case "exit-status":
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		os.Exit(42)
 	case "hook":
 		server, err := Server()
 		if err != nil {
@@ -79,9 +116,53 @@ func TestHelperProcess(*testing.T) {
 		server.Serve()
 	case "invalid-rpc-address":
 		fmt.Println("lolinvalid")
+		<-make(chan int)
 	case "mock":
 		fmt.Printf("%s|tcp|:1234\n", APIVersion)
 		<-make(chan int)
+	case "mock-unix":
+		fmt.Printf("%s|unix|/tmp/packer-plugin.sock\n", APIVersion)
+		<-make(chan int)
+	case "mock-unix-exit":
+		fmt.Printf("%s|unix|/tmp/packer-plugin.sock\n", APIVersion)
+		time.Sleep(100 * time.Millisecond)
+		os.Exit(1)
+	case "multi":
+		err := Serve(&ServeOpts{
+			BuilderFunc: func() packer.Builder {
+				return new(packer.MockBuilder)
+			},
+			PostProcessorFunc: func() packer.PostProcessor {
+				return new(helperPostProcessor)
+			},
+		})
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+	case "no-control":
+		// Serve RPC like a plugin from before the Control service
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s|tcp|%s\n", APIVersion, listener.Addr())
+
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		stream, err := packrpc.NewMuxConn(conn).Accept(0)
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		rpc.NewServer().ServeConn(stream)
+	case "port-range":
+		fmt.Printf("%s|tcp|:%s\n", APIVersion, os.Getenv("PACKER_PLUGIN_MIN_PORT"))
+		log.Printf("max port: %s", os.Getenv("PACKER_PLUGIN_MAX_PORT"))
 	case "post-processor":
 		server, err := Server()
 		if err != nil {
@@ -98,6 +179,50 @@ func TestHelperProcess(*testing.T) {
 		}
 		server.RegisterProvisioner(new(packer.MockProvisioner))
 		server.Serve()
+	case "retry":
+		if !Retried() {
+			Retry()
+		}
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		<-make(chan int)
+	case "retry-always":
+		Retry()
+	case "secrets":
+		server, err := Server()
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		server.RegisterBuilder(new(secretsBuilder))
+		server.Serve()
+	case "sigterm":
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM)
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		<-ch
+		log.Println("got SIGTERM")
+	case "sigterm-ignore":
+		signal.Ignore(syscall.SIGTERM)
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		<-make(chan int)
+	case "slow-accept":
+		// Print the address, but wait before accepting the connection
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s|tcp|%s\n", APIVersion, listener.Addr())
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+		server := packrpc.NewServer(conn)
+		server.RegisterBuilder(new(packer.MockBuilder))
+		server.Serve()
 	case "start-timeout":
 		time.Sleep(1 * time.Minute)
 		os.Exit(1)
@@ -105,6 +230,26 @@ func TestHelperProcess(*testing.T) {
 		fmt.Printf("%s|tcp|:1234\n", APIVersion)
 		log.Println("HELLO")
 		log.Println("WORLD")
+		os.Stderr.WriteString("BYE")
+	case "stderr-exit":
+		log.Println("panic: something went wrong")
+		os.Exit(1)
+	case "stderr-hold":
+		// Start a child that keeps our stderr open after we exit
+		child := exec.Command("sleep", "2")
+		child.Stderr = os.Stderr
+		if err := child.Start(); err != nil {
+			log.Printf("[ERR] %s", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		<-make(chan int)
+	case "stdout":
+		fmt.Printf("%s|tcp|:1234\n", APIVersion)
+		for i := 0; i < 1000; i++ {
+			fmt.Printf("line %d\n", i)
+		}
 	case "stdin":
 		fmt.Printf("%s|tcp|:1234\n", APIVersion)
 		data := make([]byte, 5)
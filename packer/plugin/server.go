@@ -8,6 +8,7 @@
 package plugin
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
@@ -18,8 +19,12 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // This is a count of the number of interrupts the process has received.
@@ -27,6 +32,11 @@ import (
 // be checked by the plugin safely to take action.
 var Interrupts int32 = 0
 
+// currentServer is the server returned by ServerWithAddresses, that
+// Secrets asks the host through.
+var currentServer *packrpc.Server
+var serverL sync.Mutex
+
 const MagicCookieKey = "PACKER_PLUGIN_MAGIC_COOKIE"
 const MagicCookieValue = "d602bf8f470bc67ca7faa0386276bbdd4330efaf76d1a219cb4d6991ca9872b2"
 
@@ -35,9 +45,53 @@ const MagicCookieValue = "d602bf8f470bc67ca7faa0386276bbdd4330efaf76d1a219cb4d69
 // know how to speak it.
 const APIVersion = "2"
 
+// RetryDirective is printed by a plugin instead of its address to ask
+// the client to kill it and start it again, for example after it has
+// updated itself. The client only does this if AllowRetry is set, and
+// only once. See Retry.
+const RetryDirective = "RETRY"
+
+// RetryKey is set in the environment of a plugin that was started again
+// because it printed RetryDirective.
+const RetryKey = "PACKER_PLUGIN_RETRY"
+
 // Server waits for a connection to this plugin and returns a Packer
 // RPC server that you can use to register components and serve them.
 func Server() (*packrpc.Server, error) {
+	return ServerWithAddresses(nil)
+}
+
+// Retry asks the client to start this plugin again, and waits to be
+// killed. It is called instead of Server. Plugins can check Retried to
+// tell whether they have already been started again.
+func Retry() {
+	fmt.Println(RetryDirective)
+	os.Stdout.Sync()
+
+	// Don't exit, since the client may notice that the plugin exited
+	// before it reads the directive.
+	for {
+		time.Sleep(time.Hour)
+	}
+}
+
+// Retried returns true if this plugin was started again because it
+// called Retry.
+func Retried() bool {
+	return os.Getenv(RetryKey) != ""
+}
+
+// ServerWithAddresses is like Server, but also tells the client about
+// other addresses that the plugin is serving on, keyed by name. The
+// plugin is responsible for listening on them. The client can look them
+// up with Client.Address, for example to send bulk data on a separate
+// connection from the RPC calls. Names can't contain "=", ",", or "|".
+//
+// The address is only printed once the plugin is listening on it, so the
+// client can connect as soon as it reads the address. A connection made
+// before the plugin gets to Accept waits in the listener's backlog.
+// Plugins that don't use this must keep to the same order.
+func ServerWithAddresses(addrs map[string]net.Addr) (*packrpc.Server, error) {
 	log.Printf("Plugin build against Packer '%s'", packer.GitCommit)
 
 	if os.Getenv(MagicCookieKey) != MagicCookieValue {
@@ -60,22 +114,49 @@ func Server() (*packrpc.Server, error) {
 		return nil, err
 	}
 
+	// Only listen on loopback unless the client explicitly asked for
+	// something else, so the plugin isn't reachable from other machines.
+	bindAddr := os.Getenv("PACKER_PLUGIN_BIND_ADDRESS")
+	if bindAddr == "" {
+		bindAddr = "127.0.0.1"
+	}
+
 	log.Printf("Plugin minimum port: %d\n", minPort)
 	log.Printf("Plugin maximum port: %d\n", maxPort)
 
-	listener, err := serverListener(minPort, maxPort)
+	listener, err := serverListener(bindAddr, minPort, maxPort)
 	if err != nil {
 		return nil, err
 	}
 	defer listener.Close()
 
-	// Output the address to stdout
+	// If the client gave us its certificate, then only serve over TLS
+	// and only talk to the client that holds that certificate.
+	var cert string
+	if clientCert := os.Getenv(ClientCertKey); clientCert != "" {
+		listener, cert, err = serverListener_tls(listener, clientCert)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("Plugin serving over TLS")
+	}
+
+	// Output the address to stdout. This must come after the listener
+	// is opened, since the client connects as soon as it reads this.
 	log.Printf("Plugin address: %s %s\n",
 		listener.Addr().Network(), listener.Addr().String())
-	fmt.Printf("%s|%s|%s\n",
+	line := fmt.Sprintf("%s|%s|%s",
 		APIVersion,
 		listener.Addr().Network(),
 		listener.Addr().String())
+	if cert != "" || len(addrs) > 0 {
+		line += "|" + cert
+	}
+	if len(addrs) > 0 {
+		line += "|" + encodeAddresses(addrs)
+	}
+	fmt.Println(line)
 	os.Stdout.Sync()
 
 	// Accept a connection
@@ -100,27 +181,134 @@ func Server() (*packrpc.Server, error) {
 
 	// Serve a single connection
 	log.Println("Serving a plugin connection...")
-	return packrpc.NewServer(conn), nil
+	result := packrpc.NewServer(conn)
+
+	serverL.Lock()
+	currentServer = result
+	serverL.Unlock()
+
+	return result, nil
 }
 
-func serverListener(minPort, maxPort int64) (net.Listener, error) {
+// Secrets returns the credentials that the host provides with
+// ClientConfig.Secrets. They are sent over the connection to the host
+// when this is called, so they never end up in the environment of the
+// plugin where other users of the machine could read them, for example
+// with "ps e". packrpc.ErrNoSecrets is returned if the host doesn't
+// provide any, or if the plugin isn't being served yet.
+func Secrets() (map[string]string, error) {
+	serverL.Lock()
+	s := currentServer
+	serverL.Unlock()
+
+	if s == nil {
+		return nil, packrpc.ErrNoSecrets
+	}
+
+	return s.Secrets()
+}
+
+// ServeOpts are the components that a plugin binary provides. Each func
+// that is set is called once to make the component that is served.
+type ServeOpts struct {
+	BuilderFunc       func() packer.Builder
+	PostProcessorFunc func() packer.PostProcessor
+	ProvisionerFunc   func() packer.Provisioner
+}
+
+// Serve waits for a connection to this plugin like Server, and serves
+// the given components on it until the connection is closed. A single
+// binary can provide more than one type of component, such as both a
+// builder and a post-processor. Each type is served on its own endpoint,
+// so the host gets whichever one it asks the client for, for example
+// with Client.Builder or Client.PostProcessor.
+func Serve(opts *ServeOpts) error {
+	if opts.BuilderFunc == nil && opts.PostProcessorFunc == nil && opts.ProvisionerFunc == nil {
+		return errors.New("no components to serve")
+	}
+
+	server, err := Server()
+	if err != nil {
+		return err
+	}
+
+	if opts.BuilderFunc != nil {
+		server.RegisterBuilder(opts.BuilderFunc())
+	}
+	if opts.PostProcessorFunc != nil {
+		server.RegisterPostProcessor(opts.PostProcessorFunc())
+	}
+	if opts.ProvisionerFunc != nil {
+		server.RegisterProvisioner(opts.ProvisionerFunc())
+	}
+
+	server.Serve()
+	return nil
+}
+
+// encodeAddresses encodes named addresses for the handshake line as
+// comma-separated "name=network:address" entries, sorted by name.
+func encodeAddresses(addrs map[string]net.Addr) string {
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, len(names))
+	for i, name := range names {
+		addr := addrs[name]
+		entries[i] = fmt.Sprintf("%s=%s:%s", name, addr.Network(), addr.String())
+	}
+
+	return strings.Join(entries, ",")
+}
+
+func serverListener(bindAddr string, minPort, maxPort int64) (net.Listener, error) {
 	if runtime.GOOS == "windows" {
-		return serverListener_tcp(minPort, maxPort)
+		return serverListener_tcp(bindAddr, minPort, maxPort)
 	}
 
 	return serverListener_unix()
 }
 
-func serverListener_tcp(minPort, maxPort int64) (net.Listener, error) {
+func serverListener_tcp(bindAddr string, minPort, maxPort int64) (net.Listener, error) {
 	for port := minPort; port <= maxPort; port++ {
-		address := fmt.Sprintf("127.0.0.1:%d", port)
+		address := net.JoinHostPort(bindAddr, strconv.FormatInt(port, 10))
 		listener, err := net.Listen("tcp", address)
 		if err == nil {
 			return listener, nil
 		}
 	}
 
-	return nil, errors.New("Couldn't bind plugin TCP listener")
+	return nil, fmt.Errorf(
+		"Couldn't bind plugin TCP listener on %s in port range %d-%d",
+		bindAddr, minPort, maxPort)
+}
+
+// serverListener_tls wraps the listener so that it serves TLS using a new
+// self-signed certificate, and requires clients to present the given
+// client certificate. The encoded server certificate is returned so that
+// it can be sent to the client.
+func serverListener_tls(l net.Listener, clientCert string) (net.Listener, string, error) {
+	clientPool, err := decodeCertPool(clientCert)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error decoding client certificate: %s", err)
+	}
+
+	cert, err := generateCert()
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return tls.NewListener(l, config), encodeCert(cert), nil
 }
 
 func serverListener_unix() (net.Listener, error) {
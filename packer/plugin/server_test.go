@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerListener_tcp(t *testing.T) {
+	l, err := serverListener_tcp("127.0.0.1", 40000, 41000)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	host, _, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if host != "127.0.0.1" {
+		t.Fatalf("bad: %s", l.Addr())
+	}
+}
+
+func TestServerListener_tcpOnePort(t *testing.T) {
+	l, err := serverListener_tcp("127.0.0.1", 40001, 40001)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	if l.Addr().String() != "127.0.0.1:40001" {
+		t.Fatalf("bad: %s", l.Addr())
+	}
+
+	// The only port in the range is taken now
+	if _, err := serverListener_tcp("127.0.0.1", 40001, 40001); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestEncodeAddresses(t *testing.T) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1235")
+	unixAddr, _ := net.ResolveUnixAddr("unix", "/tmp/data.sock")
+	encoded := encodeAddresses(map[string]net.Addr{
+		"upload": unixAddr,
+		"data":   tcpAddr,
+	})
+
+	expected := "data=tcp:127.0.0.1:1235,upload=unix:/tmp/data.sock"
+	if encoded != expected {
+		t.Fatalf("bad: %s", encoded)
+	}
+
+	addrs, err := parseAddresses(encoded)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(addrs) != 2 || addrs["data"].String() != "127.0.0.1:1235" {
+		t.Fatalf("bad: %#v", addrs)
+	}
+}
+
+func TestServe_noComponents(t *testing.T) {
+	if err := Serve(new(ServeOpts)); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestServe_multipleComponents(t *testing.T) {
+	c := NewClient(&ClientConfig{Cmd: helperProcess("multi")})
+	defer c.Kill()
+
+	builder, err := c.Builder()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := builder.Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	pp, err := c.PostProcessor()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := pp.Configure(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
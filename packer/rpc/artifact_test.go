@@ -11,7 +11,7 @@ func TestArtifactRPC(t *testing.T) {
 	a := new(packer.MockArtifact)
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterArtifact(a)
@@ -88,6 +88,10 @@ func (b *BuildServer) Name(args *interface{}, reply *string) error {
 
 func (b *BuildServer) Prepare(args *interface{}, resp *BuildPrepareResponse) error {
 	warnings, err := b.build.Prepare()
+	if err != nil {
+		err = NewBasicError(err)
+	}
+
 	*resp = BuildPrepareResponse{
 		Warnings: warnings,
 		Error:    err,
@@ -96,13 +100,21 @@ func (b *BuildServer) Prepare(args *interface{}, resp *BuildPrepareResponse) err
 }
 
 func (b *BuildServer) Run(streamId uint32, reply *[]uint32) error {
+	if err := b.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer b.mux.calls.done()
+
 	client, err := newClientWithMux(b.mux, streamId)
 	if err != nil {
 		return NewBasicError(err)
 	}
 	defer client.Close()
 
-	artifacts, err := b.build.Run(client.Ui(), client.Cache())
+	ui := client.Ui().(*Ui)
+	defer ui.Close()
+
+	artifacts, err := b.build.Run(ui, client.Cache())
 	if err != nil {
 		return NewBasicError(err)
 	}
@@ -13,6 +13,7 @@ type testBuild struct {
 	nameCalled      bool
 	prepareCalled   bool
 	prepareWarnings []string
+	prepareErr      error
 	runCalled       bool
 	runCache        packer.Cache
 	runUi           packer.Ui
@@ -30,7 +31,7 @@ func (b *testBuild) Name() string {
 
 func (b *testBuild) Prepare() ([]string, error) {
 	b.prepareCalled = true
-	return b.prepareWarnings, nil
+	return b.prepareWarnings, b.prepareErr
 }
 
 func (b *testBuild) Run(ui packer.Ui, cache packer.Cache) ([]packer.Artifact, error) {
@@ -59,7 +60,7 @@ func (b *testBuild) Cancel() {
 
 func TestBuild(t *testing.T) {
 	b := new(testBuild)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuild(b)
@@ -125,7 +126,7 @@ func TestBuild(t *testing.T) {
 
 func TestBuildPrepare_Warnings(t *testing.T) {
 	b := new(testBuild)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuild(b)
@@ -143,6 +144,29 @@ func TestBuildPrepare_Warnings(t *testing.T) {
 	}
 }
 
+func TestBuildPrepare_Error(t *testing.T) {
+	b := new(testBuild)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuild(b)
+	bClient := client.Build()
+
+	// A MultiError isn't registered with gob, so this only works if
+	// the server wraps it before sending it back.
+	b.prepareErr = &packer.MultiError{
+		Errors: []error{errors.New("foo")},
+	}
+
+	_, err := bClient.Prepare()
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if err.Error() != b.prepareErr.Error() {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
 func TestBuild_ImplementsBuild(t *testing.T) {
 	var _ packer.Build = new(build)
 }
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"errors"
 	"github.com/mitchellh/packer/packer"
 	"log"
 	"net/rpc"
@@ -29,6 +30,13 @@ type BuilderPrepareResponse struct {
 	Error    error
 }
 
+// The response from Builder.EffectiveConfig. Reported is false if the
+// builder can't report its effective config.
+type BuilderEffectiveConfigResponse struct {
+	Config   map[string]interface{}
+	Reported bool
+}
+
 func (b *builder) Prepare(config ...interface{}) ([]string, error) {
 	var resp BuilderPrepareResponse
 	cerr := b.client.Call("Builder.Prepare", &BuilderPrepareArgs{config}, &resp)
@@ -39,6 +47,44 @@ func (b *builder) Prepare(config ...interface{}) ([]string, error) {
 	return resp.Warnings, resp.Error
 }
 
+func (b *builder) Configure(config ...interface{}) error {
+	err := b.client.Call("Builder.Configure", &BuilderPrepareArgs{config}, new(interface{}))
+
+	// Plugins built before Configure existed don't have the method, so
+	// fall back to preparing the builder like they expect.
+	if isMissingMethod(err) {
+		warnings, err := b.Prepare(config...)
+		for _, w := range warnings {
+			log.Printf("Builder warning: %s", w)
+		}
+
+		return err
+	}
+
+	return err
+}
+
+// EffectiveConfig returns the effective config of the remote builder.
+// ErrNoEffectiveConfig is returned if the builder can't report it,
+// including when the plugin was built before this existed.
+func (b *builder) EffectiveConfig() (map[string]interface{}, error) {
+	// The argument is unused. See isMissingMethod for why it isn't nil.
+	var response BuilderEffectiveConfigResponse
+	err := b.client.Call("Builder.EffectiveConfig", true, &response)
+	if isMissingMethod(err) {
+		return nil, packer.ErrNoEffectiveConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Reported {
+		return nil, packer.ErrNoEffectiveConfig
+	}
+
+	return response.Config, nil
+}
+
 func (b *builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	nextId := b.mux.NextId()
 	server := newServerWithMux(b.mux, nextId)
@@ -64,12 +110,34 @@ func (b *builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 	return client.Artifact(), nil
 }
 
+// BuilderId returns the ID of the remote builder, or "" if it doesn't
+// have one, including when the plugin was built before this existed.
+func (b *builder) BuilderId() string {
+	var id string
+	err := b.client.Call("Builder.BuilderId", true, &id)
+	if isMissingMethod(err) {
+		return ""
+	}
+	if err != nil {
+		log.Printf("Error getting builder ID: %s", err)
+	}
+
+	return id
+}
+
 func (b *builder) Cancel() {
 	if err := b.client.Call("Builder.Cancel", new(interface{}), new(interface{})); err != nil {
 		log.Printf("Error cancelling builder: %s", err)
 	}
 }
 
+// Close closes the connection to the builder. Builders returned by
+// Environment.Builder are served on their own connection, which should
+// be closed with this once the builder is no longer needed.
+func (b *builder) Close() error {
+	return b.client.Close()
+}
+
 func (b *BuilderServer) Prepare(args *BuilderPrepareArgs, reply *BuilderPrepareResponse) error {
 	warnings, err := b.builder.Prepare(args.Configs...)
 	if err != nil {
@@ -83,14 +151,34 @@ func (b *BuilderServer) Prepare(args *BuilderPrepareArgs, reply *BuilderPrepareR
 	return nil
 }
 
+func (b *BuilderServer) Configure(args *BuilderPrepareArgs, reply *interface{}) error {
+	if err := packer.ConfigureBuilder(b.builder, args.Configs...); err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = nil
+	return nil
+}
+
 func (b *BuilderServer) Run(streamId uint32, reply *uint32) error {
+	if err := b.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer b.mux.calls.done()
+
 	client, err := newClientWithMux(b.mux, streamId)
 	if err != nil {
 		return NewBasicError(err)
 	}
 	defer client.Close()
 
-	artifact, err := b.builder.Run(client.Ui(), client.Hook(), client.Cache())
+	// Closing the Ui waits for any output that is still being sent, so
+	// that it all reaches the Ui before Run returns and the plugin can
+	// be killed.
+	ui := client.Ui().(*Ui)
+	defer ui.Close()
+
+	artifact, err := b.builder.Run(ui, client.Hook(), client.Cache())
 	if err != nil {
 		return NewBasicError(err)
 	}
@@ -107,6 +195,28 @@ func (b *BuilderServer) Run(streamId uint32, reply *uint32) error {
 	return nil
 }
 
+func (b *BuilderServer) EffectiveConfig(args bool, reply *BuilderEffectiveConfigResponse) error {
+	config, err := packer.EffectiveConfig(b.builder)
+	if errors.Is(err, packer.ErrNoEffectiveConfig) {
+		*reply = BuilderEffectiveConfigResponse{}
+		return nil
+	}
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = BuilderEffectiveConfigResponse{
+		Config:   config,
+		Reported: true,
+	}
+	return nil
+}
+
+func (b *BuilderServer) BuilderId(args bool, reply *string) error {
+	*reply = packer.BuilderId(b.builder)
+	return nil
+}
+
 func (b *BuilderServer) Cancel(args *interface{}, reply *interface{}) error {
 	b.builder.Cancel()
 	return nil
@@ -1,16 +1,18 @@
 package rpc
 
 import (
+	"errors"
 	"github.com/mitchellh/packer/packer"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var testBuilderArtifact = &packer.MockArtifact{}
 
 func TestBuilderPrepare(t *testing.T) {
 	b := new(packer.MockBuilder)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -35,9 +37,82 @@ func TestBuilderPrepare(t *testing.T) {
 	}
 }
 
+func TestBuilderPrepare_configMap(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	// This is the shape of a config decoded from JSON
+	config := map[string]interface{}{
+		"name":    "foo",
+		"count":   float64(2),
+		"enabled": true,
+		"tags":    []interface{}{"a", float64(1), false},
+		"nested": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{"key": "value"},
+			},
+		},
+	}
+
+	if _, err := bClient.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(b.PrepareConfig, []interface{}{config}) {
+		t.Fatalf("bad: %#v", b.PrepareConfig)
+	}
+}
+
+func TestBuilderPrepare_multipleConfigs(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	if _, err := bClient.Prepare(42, "foo"); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !reflect.DeepEqual(b.PrepareConfig, []interface{}{42, "foo"}) {
+		t.Fatalf("bad: %#v", b.PrepareConfig)
+	}
+}
+
+type testBuilderConfig struct {
+	Name string
+}
+
+func init() {
+	RegisterBuilderConfig(new(testBuilderConfig))
+}
+
+func TestBuilderPrepare_registeredConfig(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	config := &testBuilderConfig{Name: "foo"}
+	if _, err := bClient.Prepare(config); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if !reflect.DeepEqual(b.PrepareConfig, []interface{}{config}) {
+		t.Fatalf("bad: %#v", b.PrepareConfig)
+	}
+}
+
 func TestBuilderPrepare_Warnings(t *testing.T) {
 	b := new(packer.MockBuilder)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -58,7 +133,7 @@ func TestBuilderPrepare_Warnings(t *testing.T) {
 
 func TestBuilderRun(t *testing.T) {
 	b := new(packer.MockBuilder)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -86,7 +161,7 @@ func TestBuilderRun_nilResult(t *testing.T) {
 	b := new(packer.MockBuilder)
 	b.RunNilResult = true
 
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -106,7 +181,7 @@ func TestBuilderRun_nilResult(t *testing.T) {
 
 func TestBuilderRun_ErrResult(t *testing.T) {
 	b := new(packer.MockBuilder)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -128,7 +203,7 @@ func TestBuilderRun_ErrResult(t *testing.T) {
 
 func TestBuilderCancel(t *testing.T) {
 	b := new(packer.MockBuilder)
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterBuilder(b)
@@ -140,6 +215,325 @@ func TestBuilderCancel(t *testing.T) {
 	}
 }
 
+// cancelBuilder is a builder whose Run blocks until it is cancelled.
+type cancelBuilder struct {
+	packer.MockBuilder
+	cancelCh chan struct{}
+}
+
+func (b *cancelBuilder) Run(packer.Ui, packer.Hook, packer.Cache) (packer.Artifact, error) {
+	<-b.cancelCh
+	return nil, errors.New("cancelled")
+}
+
+func (b *cancelBuilder) Cancel() {
+	close(b.cancelCh)
+}
+
+func TestBuilderCancel_duringRun(t *testing.T) {
+	b := &cancelBuilder{cancelCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache))
+		errCh <- err
+	}()
+
+	bClient.Cancel()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("should have error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run should finish after cancel")
+	}
+}
+
+// artifactBuilder is a builder that reports an artifact while it runs,
+// and waits for it to be received before returning.
+type artifactBuilder struct {
+	packer.MockBuilder
+	doneCh chan struct{}
+}
+
+func (b *artifactBuilder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
+	packer.ReportArtifact(hook, &packer.MockArtifact{IdValue: "early"})
+	<-b.doneCh
+	return testBuilderArtifact, nil
+}
+
+// artifactHook records the IDs of the artifacts reported to it.
+type artifactHook struct {
+	packer.MockHook
+	artifactCh chan string
+}
+
+func (h *artifactHook) Artifact(a packer.Artifact) {
+	h.artifactCh <- a.Id()
+}
+
+func TestBuilderRun_reportArtifact(t *testing.T) {
+	b := &artifactBuilder{doneCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	hook := &artifactHook{artifactCh: make(chan string, 1)}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := bClient.Run(new(testUi), hook, new(testCache))
+		errCh <- err
+	}()
+
+	// The artifact arrives while the builder is still running
+	select {
+	case id := <-hook.artifactCh:
+		if id != "early" {
+			t.Fatalf("bad: %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should report the artifact")
+	}
+
+	close(b.doneCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// configureBuilder is a builder that applies its defaults in Configure.
+type configureBuilder struct {
+	packer.MockBuilder
+	configureConfig []interface{}
+}
+
+func (b *configureBuilder) Configure(raws ...interface{}) error {
+	b.configureConfig = raws
+	return nil
+}
+
+func TestBuilderConfigure(t *testing.T) {
+	b := new(configureBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder().(*builder)
+
+	if err := bClient.Configure(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(b.configureConfig, []interface{}{42}) {
+		t.Fatalf("bad: %#v", b.configureConfig)
+	}
+	if b.PrepareCalled {
+		t.Fatal("prepare should not be called")
+	}
+}
+
+func TestBuilderConfigure_prepare(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder().(*builder)
+
+	if err := bClient.Configure(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(b.PrepareConfig, []interface{}{42}) {
+		t.Fatalf("bad: %#v", b.PrepareConfig)
+	}
+}
+
+// oldBuilderServer is a BuilderServer from before Configure existed.
+type oldBuilderServer struct {
+	server *BuilderServer
+}
+
+func (s *oldBuilderServer) Prepare(args *BuilderPrepareArgs, reply *BuilderPrepareResponse) error {
+	return s.server.Prepare(args, reply)
+}
+
+func TestBuilderConfigure_oldPlugin(t *testing.T) {
+	b := new(configureBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultBuilderEndpoint, &oldBuilderServer{
+		server: &BuilderServer{builder: b, mux: server.mux},
+	})
+	bClient := client.Builder().(*builder)
+
+	if err := bClient.Configure(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(b.PrepareConfig, []interface{}{42}) {
+		t.Fatalf("bad: %#v", b.PrepareConfig)
+	}
+}
+
+// configReportBuilder is a builder that reports its effective config.
+type configReportBuilder struct {
+	packer.MockBuilder
+}
+
+func (b *configReportBuilder) EffectiveConfig() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"name":  "foo",
+		"disks": []interface{}{"a", "b"},
+		"tags":  map[string]interface{}{"env": "test"},
+	}, nil
+}
+
+func TestBuilderEffectiveConfig(t *testing.T) {
+	b := new(configReportBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	config, err := packer.EffectiveConfig(client.Builder())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected, _ := b.EffectiveConfig()
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("bad: %#v", config)
+	}
+}
+
+func TestBuilderEffectiveConfig_none(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	if _, err := packer.EffectiveConfig(client.Builder()); err != packer.ErrNoEffectiveConfig {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// configErrorBuilder is a builder that fails to report its config.
+type configErrorBuilder struct {
+	packer.MockBuilder
+}
+
+func (b *configErrorBuilder) EffectiveConfig() (map[string]interface{}, error) {
+	return nil, errors.New("config is gone")
+}
+
+func TestBuilderEffectiveConfig_error(t *testing.T) {
+	b := new(configErrorBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	_, err := packer.EffectiveConfig(client.Builder())
+	if err == nil || err.Error() != "config is gone" {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestBuilderEffectiveConfig_oldPlugin(t *testing.T) {
+	b := new(configReportBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultBuilderEndpoint, &oldBuilderServer{
+		server: &BuilderServer{builder: b, mux: server.mux},
+	})
+
+	if _, err := packer.EffectiveConfig(client.Builder()); err != packer.ErrNoEffectiveConfig {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+type idBuilder struct {
+	packer.MockBuilder
+}
+
+func (b *idBuilder) BuilderId() string {
+	return "foo"
+}
+
+func TestBuilderBuilderId(t *testing.T) {
+	b := new(idBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	if id := packer.BuilderId(client.Builder()); id != "foo" {
+		t.Fatalf("bad: %#v", id)
+	}
+}
+
+func TestBuilderBuilderId_none(t *testing.T) {
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	if id := packer.BuilderId(client.Builder()); id != "" {
+		t.Fatalf("bad: %#v", id)
+	}
+}
+
+func TestBuilderBuilderId_oldPlugin(t *testing.T) {
+	b := new(idBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultBuilderEndpoint, &oldBuilderServer{
+		server: &BuilderServer{builder: b, mux: server.mux},
+	})
+	bClient := client.Builder()
+
+	if id := packer.BuilderId(bClient); id != "" {
+		t.Fatalf("bad: %#v", id)
+	}
+
+	// The connection still works for everything else
+	if _, err := bClient.Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestTestBuilderClient(t *testing.T) {
+	b := new(packer.MockBuilder)
+	bClient := TestBuilderClient(t, b)
+
+	if _, err := bClient.Prepare(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !b.PrepareCalled {
+		t.Fatal("should be called")
+	}
+
+	artifact, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if artifact.Id() != testBuilderArtifact.Id() {
+		t.Fatalf("bad: %s", artifact.Id())
+	}
+}
+
 func TestBuilder_ImplementsBuilder(t *testing.T) {
 	var _ packer.Builder = new(builder)
 }
@@ -47,7 +47,7 @@ func TestCacheRPC(t *testing.T) {
 	c := new(testCache)
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterCache(c)
@@ -55,10 +55,13 @@ func TestCacheRPC(t *testing.T) {
 	cacheClient := client.Cache()
 
 	// Test Lock
-	cacheClient.Lock("foo")
+	path := cacheClient.Lock("foo")
 	if !c.lockCalled {
 		t.Fatal("should be called")
 	}
+	if path != "foo" {
+		t.Fatalf("bad: %s", path)
+	}
 	if c.lockKey != "foo" {
 		t.Fatalf("bad: %s", c.lockKey)
 	}
@@ -73,10 +76,13 @@ func TestCacheRPC(t *testing.T) {
 	}
 
 	// Test RLock
-	cacheClient.RLock("foo")
+	path, exists := cacheClient.RLock("foo")
 	if !c.rlockCalled {
 		t.Fatal("should be called")
 	}
+	if path != "foo" || !exists {
+		t.Fatalf("bad: %s %#v", path, exists)
+	}
 	if c.rlockKey != "foo" {
 		t.Fatalf("bad: %s", c.rlockKey)
 	}
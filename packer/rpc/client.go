@@ -1,10 +1,12 @@
 package rpc
 
 import (
+	"errors"
 	"github.com/mitchellh/packer/packer"
 	"io"
 	"log"
 	"net/rpc"
+	"time"
 )
 
 // Client is the client end that communicates with a Packer RPC server.
@@ -32,9 +34,19 @@ func newClientWithMux(mux *MuxConn, streamId uint32) (*Client, error) {
 		return nil, err
 	}
 
+	var codec rpc.ClientCodec
+	if mux.requestIds {
+		codec = newRequestIdClientCodec(clientConn)
+	} else {
+		codec = newGobClientCodec(clientConn)
+	}
+	if mux.observer != nil {
+		codec = newObservingClientCodec(codec, mux.observer)
+	}
+
 	return &Client{
 		mux:      mux,
-		client:   rpc.NewClient(clientConn),
+		client:   rpc.NewClientWithCodec(codec),
 		closeMux: false,
 	}, nil
 }
@@ -52,6 +64,40 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// ErrPingUnsupported is returned by Ping if the server was built before
+// it could be pinged.
+var ErrPingUnsupported = errors.New("plugin doesn't support ping")
+
+// Ping makes a round-trip call to the server, returning an error if the
+// server couldn't be reached. This only works against the root server
+// created with NewServer.
+func (c *Client) Ping() error {
+	err := c.client.Call(DefaultControlEndpoint+".Ping", true, new(interface{}))
+	if isMissingMethod(err) {
+		return ErrPingUnsupported
+	}
+
+	return err
+}
+
+// ErrShutdownUnsupported is returned by Shutdown if the server was built
+// before it could be shut down.
+var ErrShutdownUnsupported = errors.New("plugin doesn't support shutdown")
+
+// Shutdown asks the server to stop accepting long running calls, such as
+// Builder.Run, and to wait up to timeout for the ones in progress to
+// finish. It returns true if they all finished in time. This only works
+// against the root server created with NewServer.
+func (c *Client) Shutdown(timeout time.Duration) (bool, error) {
+	var drained bool
+	err := c.client.Call(DefaultControlEndpoint+".Shutdown", timeout, &drained)
+	if isMissingMethod(err) {
+		return false, ErrShutdownUnsupported
+	}
+
+	return drained, err
+}
+
 func (c *Client) Artifact() packer.Artifact {
 	return &artifact{
 		client:   c.client,
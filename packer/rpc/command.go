@@ -68,6 +68,11 @@ func (c *CommandServer) Help(args *interface{}, reply *string) error {
 }
 
 func (c *CommandServer) Run(args *CommandRunArgs, reply *int) error {
+	if err := c.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer c.mux.calls.done()
+
 	client, err := newClientWithMux(c.mux, args.StreamId)
 	if err != nil {
 		return NewBasicError(err)
@@ -32,7 +32,7 @@ func TestRPCCommand(t *testing.T) {
 	command := new(TestCommand)
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterCommand(command)
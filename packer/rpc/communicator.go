@@ -6,8 +6,13 @@ import (
 	"io"
 	"log"
 	"net/rpc"
+	"time"
 )
 
+// progressInterval is how often at most the server side of a transfer
+// reports its progress to the client.
+var progressInterval = 100 * time.Millisecond
+
 // An implementation of packer.Communicator where the communicator is actually
 // executed over an RPC connection.
 type communicator struct {
@@ -34,14 +39,31 @@ type CommunicatorStartArgs struct {
 	ResponseStreamId uint32
 }
 
+// ProgressStreamId in these is the stream that a TransferProgressServer
+// is served on, or 0 if progress isn't reported.
 type CommunicatorDownloadArgs struct {
-	Path           string
-	WriterStreamId uint32
+	Path             string
+	WriterStreamId   uint32
+	ProgressStreamId uint32
 }
 
 type CommunicatorUploadArgs struct {
-	Path           string
-	ReaderStreamId uint32
+	Path             string
+	ReaderStreamId   uint32
+	Total            int64
+	ProgressStreamId uint32
+}
+
+// The arguments sent to TransferProgress.Report
+type CommunicatorProgressArgs struct {
+	Written int64
+	Total   int64
+}
+
+// TransferProgressServer is served by the client of an upload or
+// download so that the server side can report its progress.
+type TransferProgressServer struct {
+	fn packer.TransferProgressFunc
 }
 
 type CommunicatorUploadDirArgs struct {
@@ -104,17 +126,27 @@ func (c *communicator) Start(cmd *packer.RemoteCmd) (err error) {
 }
 
 func (c *communicator) Upload(path string, r io.Reader) (err error) {
+	return c.upload(path, r, CommunicatorUploadArgs{})
+}
+
+func (c *communicator) UploadWithProgress(path string, r io.Reader, total int64, fn packer.TransferProgressFunc) error {
+	progressId := c.serveProgress(fn)
+	defer c.mux.cancelAccept(progressId)
+
+	return c.upload(path, r, CommunicatorUploadArgs{
+		Total:            total,
+		ProgressStreamId: progressId,
+	})
+}
+
+func (c *communicator) upload(path string, r io.Reader, args CommunicatorUploadArgs) error {
 	// Pipe the reader through to the connection
 	streamId := c.mux.NextId()
 	go serveSingleCopy("uploadData", c.mux, streamId, nil, r)
 
-	args := CommunicatorUploadArgs{
-		Path:           path,
-		ReaderStreamId: streamId,
-	}
-
-	err = c.client.Call("Communicator.Upload", &args, new(interface{}))
-	return
+	args.Path = path
+	args.ReaderStreamId = streamId
+	return c.client.Call("Communicator.Upload", &args, new(interface{}))
 }
 
 func (c *communicator) UploadDir(dst string, src string, exclude []string) error {
@@ -134,17 +166,39 @@ func (c *communicator) UploadDir(dst string, src string, exclude []string) error
 }
 
 func (c *communicator) Download(path string, w io.Writer) (err error) {
+	return c.download(path, w, CommunicatorDownloadArgs{})
+}
+
+func (c *communicator) DownloadWithProgress(path string, w io.Writer, fn packer.TransferProgressFunc) error {
+	progressId := c.serveProgress(fn)
+	defer c.mux.cancelAccept(progressId)
+
+	return c.download(path, w, CommunicatorDownloadArgs{
+		ProgressStreamId: progressId,
+	})
+}
+
+func (c *communicator) download(path string, w io.Writer, args CommunicatorDownloadArgs) error {
 	// Serve a single connection and a single copy
 	streamId := c.mux.NextId()
 	go serveSingleCopy("downloadWriter", c.mux, streamId, w, nil)
 
-	args := CommunicatorDownloadArgs{
-		Path:           path,
-		WriterStreamId: streamId,
-	}
+	args.Path = path
+	args.WriterStreamId = streamId
+	return c.client.Call("Communicator.Download", &args, new(interface{}))
+}
 
-	err = c.client.Call("Communicator.Download", &args, new(interface{}))
-	return
+// serveProgress serves a TransferProgressServer that calls fn on a new
+// stream, and returns the ID of the stream. The other side may never
+// connect to it, for example if it was built before progress existed, so
+// the stream must be cancelled with cancelAccept once the transfer is
+// done.
+func (c *communicator) serveProgress(fn packer.TransferProgressFunc) uint32 {
+	streamId := c.mux.NextId()
+	server := newServerWithMux(c.mux, streamId)
+	server.server.RegisterName("TransferProgress", &TransferProgressServer{fn: fn})
+	go server.Serve()
+	return streamId
 }
 
 func (c *CommunicatorServer) Start(args *CommunicatorStartArgs, reply *interface{}) error {
@@ -233,7 +287,18 @@ func (c *CommunicatorServer) Upload(args *CommunicatorUploadArgs, reply *interfa
 	}
 	defer readerC.Close()
 
-	err = c.c.Upload(args.Path, readerC)
+	if args.ProgressStreamId == 0 {
+		err = c.c.Upload(args.Path, readerC)
+		return
+	}
+
+	progress, err := c.dialProgress(args.ProgressStreamId)
+	if err != nil {
+		return
+	}
+	defer progress.close()
+
+	err = packer.UploadWithProgress(c.c, args.Path, readerC, args.Total, progress.report)
 	return
 }
 
@@ -248,10 +313,72 @@ func (c *CommunicatorServer) Download(args *CommunicatorDownloadArgs, reply *int
 	}
 	defer writerC.Close()
 
-	err = c.c.Download(args.Path, writerC)
+	if args.ProgressStreamId == 0 {
+		err = c.c.Download(args.Path, writerC)
+		return
+	}
+
+	progress, err := c.dialProgress(args.ProgressStreamId)
+	if err != nil {
+		return
+	}
+	defer progress.close()
+
+	err = packer.DownloadWithProgress(c.c, args.Path, writerC, progress.report)
 	return
 }
 
+// dialProgress connects to the TransferProgressServer of a transfer.
+func (c *CommunicatorServer) dialProgress(streamId uint32) (*progressReporter, error) {
+	client, err := newClientWithMux(c.mux, streamId)
+	if err != nil {
+		return nil, NewBasicError(err)
+	}
+
+	return &progressReporter{client: client}, nil
+}
+
+func (s *TransferProgressServer) Report(args *CommunicatorProgressArgs, reply *interface{}) error {
+	s.fn(args.Written, args.Total)
+	return nil
+}
+
+// progressReporter sends the progress of a transfer to the client's
+// TransferProgressServer, at most every progressInterval so that small
+// reads and writes don't each cost a round-trip.
+type progressReporter struct {
+	client  *Client
+	last    time.Time
+	pending bool
+	args    CommunicatorProgressArgs
+}
+
+func (p *progressReporter) report(written, total int64) {
+	p.args = CommunicatorProgressArgs{Written: written, Total: total}
+	p.pending = true
+	if time.Since(p.last) >= progressInterval {
+		p.send()
+	}
+}
+
+// close sends the last progress, if it wasn't sent yet, and closes the
+// connection.
+func (p *progressReporter) close() {
+	if p.pending {
+		p.send()
+	}
+
+	p.client.Close()
+}
+
+func (p *progressReporter) send() {
+	p.last = time.Now()
+	p.pending = false
+	if err := p.client.client.Call("TransferProgress.Report", &p.args, new(interface{})); err != nil {
+		log.Printf("[ERR] Error reporting transfer progress: %s", err)
+	}
+}
+
 func serveSingleCopy(name string, mux *MuxConn, id uint32, dst io.Writer, src io.Reader) {
 	conn, err := mux.Accept(id)
 	if err != nil {
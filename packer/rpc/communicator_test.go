@@ -5,7 +5,10 @@ import (
 	"github.com/mitchellh/packer/packer"
 	"io"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCommunicatorRPC(t *testing.T) {
@@ -13,7 +16,7 @@ func TestCommunicatorRPC(t *testing.T) {
 	c := new(packer.MockCommunicator)
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterCommunicator(c)
@@ -156,6 +159,105 @@ func TestCommunicatorRPC(t *testing.T) {
 	}
 }
 
+func TestCommunicatorRPC_progress(t *testing.T) {
+	c := new(packer.MockCommunicator)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterCommunicator(c)
+	remote := client.Communicator()
+
+	var written, total int64
+	fn := func(w, t int64) {
+		written, total = w, t
+	}
+
+	err := packer.UploadWithProgress(remote, "foo", strings.NewReader("hello"), 5, fn)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.UploadData != "hello" {
+		t.Fatalf("bad: %s", c.UploadData)
+	}
+	if written != 5 || total != 5 {
+		t.Fatalf("bad: %d/%d", written, total)
+	}
+
+	// The size of a download is never known
+	downloadR, downloadW := io.Pipe()
+	downloadCh := make(chan string, 1)
+	go func() {
+		data, _ := bufio.NewReader(downloadR).ReadString('\n')
+		downloadCh <- data
+	}()
+
+	c.DownloadData = "download\n"
+	if err := packer.DownloadWithProgress(remote, "bar", downloadW, fn); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if data := <-downloadCh; data != "download\n" {
+		t.Fatalf("bad: %s", data)
+	}
+	if written != 9 || total != -1 {
+		t.Fatalf("bad: %d/%d", written, total)
+	}
+}
+
+// oldCommunicatorServer is a CommunicatorServer from before progress
+// existed, which never connects to the progress stream.
+type oldCommunicatorServer struct {
+	server *CommunicatorServer
+}
+
+func (s *oldCommunicatorServer) Upload(args *CommunicatorUploadArgs, reply *interface{}) error {
+	args.ProgressStreamId = 0
+	return s.server.Upload(args, reply)
+}
+
+func (s *oldCommunicatorServer) Download(args *CommunicatorDownloadArgs, reply *interface{}) error {
+	args.ProgressStreamId = 0
+	return s.server.Download(args, reply)
+}
+
+func TestCommunicatorRPC_progressOldHost(t *testing.T) {
+	c := new(packer.MockCommunicator)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultCommunicatorEndpoint, &oldCommunicatorServer{
+		server: &CommunicatorServer{c: c, mux: server.mux},
+	})
+	remote := client.Communicator()
+
+	// Make sure the goroutines for the connection itself are running
+	if err := remote.Upload("foo", strings.NewReader("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	before := runtime.NumGoroutine()
+
+	fn := func(written, total int64) {}
+	for i := 0; i < 5; i++ {
+		err := packer.UploadWithProgress(remote, "foo", strings.NewReader("hello"), 5, fn)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if c.UploadData != "hello" {
+		t.Fatalf("bad: %s", c.UploadData)
+	}
+
+	// The progress servers that were never connected to are stopped
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
+
 func TestCommunicator_ImplementsCommunicator(t *testing.T) {
 	var raw interface{}
 	raw = Communicator(nil)
@@ -163,3 +265,7 @@ func TestCommunicator_ImplementsCommunicator(t *testing.T) {
 		t.Fatal("should be a Communicator")
 	}
 }
+
+func TestCommunicator_ImplementsProgressCommunicator(t *testing.T) {
+	var _ packer.ProgressCommunicator = new(communicator)
+}
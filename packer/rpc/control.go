@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ControlServer is registered on the root server of every Packer RPC
+// connection and answers calls about the connection itself, rather than
+// about any single component.
+type ControlServer struct {
+	mux *MuxConn
+}
+
+func (c *ControlServer) Ping(args bool, reply *interface{}) error {
+	*reply = nil
+	return nil
+}
+
+// Shutdown stops the connection from accepting new long running calls,
+// such as Builder.Run, and waits up to the given timeout for the ones in
+// progress to finish. The reply is true if they all finished in time.
+func (c *ControlServer) Shutdown(timeout time.Duration, reply *bool) error {
+	*reply = c.mux.calls.drain(timeout)
+	return nil
+}
+
+// callTracker keeps track of the long running calls being served on a
+// connection so that they can be drained before the plugin is killed.
+type callTracker struct {
+	l        sync.Mutex
+	active   int
+	draining bool
+	idleCh   chan struct{}
+}
+
+// start marks that a call has started. It returns an error if the
+// connection is being drained and shouldn't accept new calls.
+func (t *callTracker) start() error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.draining {
+		return errors.New("plugin is shutting down")
+	}
+
+	t.active++
+	return nil
+}
+
+// done marks that a call started with start has finished.
+func (t *callTracker) done() {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.active--
+	if t.active == 0 && t.idleCh != nil {
+		close(t.idleCh)
+		t.idleCh = nil
+	}
+}
+
+// drain stops new calls from starting and waits up to timeout for the
+// active calls to finish, returning true if they did.
+func (t *callTracker) drain(timeout time.Duration) bool {
+	t.l.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.l.Unlock()
+		return true
+	}
+
+	if t.idleCh == nil {
+		t.idleCh = make(chan struct{})
+	}
+	idleCh := t.idleCh
+	t.l.Unlock()
+
+	select {
+	case <-idleCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"testing"
+	"time"
+)
+
+func TestControlPing(t *testing.T) {
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// testOldClientServer is like TestClientServer, but the server is like
+// the ones from before the Control service existed.
+func testOldClientServer(t *testing.T) (*Client, *Server) {
+	clientConn, serverConn := TestConn(t)
+
+	server := newServerWithMux(NewMuxConn(serverConn), 0)
+	server.closeMux = true
+	go server.Serve()
+
+	client, err := NewClient(clientConn)
+	if err != nil {
+		server.Close()
+		t.Fatalf("err: %s", err)
+	}
+
+	return client, server
+}
+
+func TestControlPing_oldPlugin(t *testing.T) {
+	client, server := testOldClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(new(packer.MockBuilder))
+
+	if err := client.Ping(); err != ErrPingUnsupported {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The connection still works for everything else
+	if _, err := client.Builder().Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestControlShutdown(t *testing.T) {
+	b := &cancelBuilder{cancelCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache))
+		errCh <- err
+	}()
+
+	// Wait for the run to start
+	for i := 0; ; i++ {
+		server.mux.calls.l.Lock()
+		active := server.mux.calls.active
+		server.mux.calls.l.Unlock()
+		if active > 0 {
+			break
+		}
+
+		if i > 100 {
+			t.Fatal("run should start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The run is still going, so it can't be drained
+	drained, err := client.Shutdown(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if drained {
+		t.Fatal("should not be drained")
+	}
+
+	// No new long running calls are accepted
+	if _, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache)); err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Once the run finishes, it drains
+	bClient.Cancel()
+	<-errCh
+
+	drained, err = client.Shutdown(5 * time.Second)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !drained {
+		t.Fatal("should be drained")
+	}
+}
@@ -1,14 +1,34 @@
 package rpc
 
 import (
+	"context"
+	"fmt"
 	"github.com/mitchellh/packer/packer"
 	"log"
 	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// cliId is used to give every Cli call a unique ID so that it can be
+// cancelled with Environment.CancelCli.
+var cliId uint64
+
+// CliTimeoutExitCode is the exit code of an Environment.Cli call whose
+// deadline passed before the command finished. It is the same code that
+// timeout(1) uses, so that scripts can tell a timeout apart from the
+// command failing. Unless the remote environment is a CliContexter, the
+// command isn't stopped and may still finish later.
+const CliTimeoutExitCode = 124
+
 // A Environment is an implementation of the packer.Environment interface
 // where the actual environment is executed over an RPC connection.
 type Environment struct {
+	// CallTimeout is the maximum time to wait for any single call to the
+	// remote environment to complete. If it is zero, calls wait forever.
+	CallTimeout time.Duration
+
 	client *rpc.Client
 	mux    *MuxConn
 }
@@ -18,15 +38,36 @@ type Environment struct {
 type EnvironmentServer struct {
 	env packer.Environment
 	mux *MuxConn
+
+	cliLock    sync.Mutex
+	cliCancels map[uint64]context.CancelFunc
 }
 
+// Deadline, if not zero, is when the server stops waiting for the
+// command and returns CliTimeoutExitCode. The command itself is only
+// stopped if the environment is a CliContexter.
 type EnvironmentCliArgs struct {
-	Args []string
+	Args     []string
+	Id       uint64
+	Deadline time.Time
+}
+
+// CliContexter is implemented by environments whose Cli can be
+// cancelled, like the one made by packer.NewEnvironment, which stops
+// commands that are a packer.ContextCommand. If the environment served
+// by an EnvironmentServer implements it, then cancelling a remote
+// CliContext cancels the context passed to it. Other environments can't
+// be stopped: cancelling only abandons the call, and the command keeps
+// running in the background.
+type CliContexter interface {
+	CliContext(context.Context, []string) (int, error)
 }
 
+// Builder returns the named builder from the remote environment. The
+// builder is served on a connection of its own, so the returned builder
+// implements io.Closer and must be closed once it is no longer needed.
 func (e *Environment) Builder(name string) (b packer.Builder, err error) {
-	var streamId uint32
-	err = e.client.Call("Environment.Builder", name, &streamId)
+	streamId, err := e.callStream("Environment.Builder", name)
 	if err != nil {
 		return
 	}
@@ -40,8 +81,8 @@ func (e *Environment) Builder(name string) (b packer.Builder, err error) {
 }
 
 func (e *Environment) Cache() packer.Cache {
-	var streamId uint32
-	if err := e.client.Call("Environment.Cache", new(interface{}), &streamId); err != nil {
+	streamId, err := e.callStream("Environment.Cache", new(interface{}))
+	if err != nil {
 		panic(err)
 	}
 
@@ -54,14 +95,63 @@ func (e *Environment) Cache() packer.Cache {
 }
 
 func (e *Environment) Cli(args []string) (result int, err error) {
-	rpcArgs := &EnvironmentCliArgs{args}
-	err = e.client.Call("Environment.Cli", rpcArgs, &result)
-	return
+	return e.CliContext(context.Background(), args)
+}
+
+// CliContext is like Cli, but cancels the remote call when the context
+// is done and returns the context's error without waiting for it. The
+// remote call is cancelled the same way if CallTimeout is reached. This
+// only stops the command if the remote environment is a CliContexter.
+//
+// If the context has a deadline, it is sent along so that the remote
+// side gives up at the deadline too, and CliTimeoutExitCode is returned
+// once it passes.
+func (e *Environment) CliContext(ctx context.Context, args []string) (int, error) {
+	var timeout <-chan time.Time
+	if e.CallTimeout > 0 {
+		timeout = time.After(e.CallTimeout)
+	}
+
+	rpcArgs := &EnvironmentCliArgs{
+		Args: args,
+		Id:   atomic.AddUint64(&cliId, 1),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		rpcArgs.Deadline = deadline
+	}
+
+	var result int
+	call := e.client.Go("Environment.Cli", rpcArgs, &result, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return result, call.Error
+	case <-timeout:
+		e.cancelCli(rpcArgs.Id)
+		return 1, fmt.Errorf(
+			"timeout waiting for Environment.Cli to complete after %s", e.CallTimeout)
+	case <-ctx.Done():
+		e.cancelCli(rpcArgs.Id)
+		if ctx.Err() == context.DeadlineExceeded {
+			return CliTimeoutExitCode, ctx.Err()
+		}
+
+		return 1, ctx.Err()
+	}
+}
+
+// cancelCli cancels the remote Cli call with the given ID in the
+// background, since the remote side may be stuck.
+func (e *Environment) cancelCli(id uint64) {
+	go func() {
+		err := e.client.Call("Environment.CancelCli", id, new(interface{}))
+		if err != nil {
+			log.Printf("[ERR] Error cancelling Cli: %s", err)
+		}
+	}()
 }
 
 func (e *Environment) Hook(name string) (h packer.Hook, err error) {
-	var streamId uint32
-	err = e.client.Call("Environment.Hook", name, &streamId)
+	streamId, err := e.callStream("Environment.Hook", name)
 	if err != nil {
 		return
 	}
@@ -74,8 +164,7 @@ func (e *Environment) Hook(name string) (h packer.Hook, err error) {
 }
 
 func (e *Environment) PostProcessor(name string) (p packer.PostProcessor, err error) {
-	var streamId uint32
-	err = e.client.Call("Environment.PostProcessor", name, &streamId)
+	streamId, err := e.callStream("Environment.PostProcessor", name)
 	if err != nil {
 		return
 	}
@@ -89,8 +178,7 @@ func (e *Environment) PostProcessor(name string) (p packer.PostProcessor, err er
 }
 
 func (e *Environment) Provisioner(name string) (p packer.Provisioner, err error) {
-	var streamId uint32
-	err = e.client.Call("Environment.Provisioner", name, &streamId)
+	streamId, err := e.callStream("Environment.Provisioner", name)
 	if err != nil {
 		return
 	}
@@ -104,15 +192,54 @@ func (e *Environment) Provisioner(name string) (p packer.Provisioner, err error)
 }
 
 func (e *Environment) Ui() packer.Ui {
-	var streamId uint32
-	e.client.Call("Environment.Ui", new(interface{}), &streamId)
+	streamId, err := e.callStream("Environment.Ui", new(interface{}))
+	if err != nil {
+		log.Printf("[ERR] Error getting Ui: %s", err)
+		return &offlineUi{err: err}
+	}
 
 	client, err := newClientWithMux(e.mux, streamId)
 	if err != nil {
 		log.Printf("[ERR] Error connecting to Ui: %s", err)
-		return nil
+		return &offlineUi{err: err}
+	}
+
+	ui := client.Ui().(*Ui)
+	ui.closeClient = true
+	return ui
+}
+
+// callStream calls the given method on the remote environment, which
+// serves a component and replies with the ID of the stream it is served
+// on. An error is returned if CallTimeout is set and the call takes
+// longer than that. The component is then closed once the reply comes,
+// so that the other side doesn't keep serving it.
+func (e *Environment) callStream(method string, args interface{}) (uint32, error) {
+	var streamId uint32
+	if e.CallTimeout <= 0 {
+		err := e.client.Call(method, args, &streamId)
+		return streamId, err
+	}
+
+	call := e.client.Go(method, args, &streamId, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return streamId, call.Error
+	case <-time.After(e.CallTimeout):
+		go func() {
+			<-call.Done
+			if call.Error != nil {
+				return
+			}
+
+			if client, err := newClientWithMux(e.mux, streamId); err == nil {
+				client.Close()
+			}
+		}()
+
+		return 0, fmt.Errorf(
+			"timeout waiting for %s to complete after %s", method, e.CallTimeout)
 	}
-	return client.Ui()
 }
 
 func (e *EnvironmentServer) Builder(name string, reply *uint32) error {
@@ -121,38 +248,135 @@ func (e *EnvironmentServer) Builder(name string, reply *uint32) error {
 		return NewBasicError(err)
 	}
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterBuilder(builder)
-	go server.Serve()
+	// Some environments return no builder and no error when the builder
+	// isn't found. Serving a nil builder would only make the client fail
+	// later with a remote panic.
+	if builder == nil {
+		return NewBasicError(fmt.Errorf("no builder named %q", name))
+	}
+
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterBuilder(builder)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
 
 func (e *EnvironmentServer) Cache(args *interface{}, reply *uint32) error {
 	cache := e.env.Cache()
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterCache(cache)
-	go server.Serve()
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterCache(cache)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
 
 func (e *EnvironmentServer) Cli(args *EnvironmentCliArgs, reply *int) (err error) {
-	*reply, err = e.env.Cli(args.Args)
+	_, ok := e.env.(CliContexter)
+	if !ok && args.Deadline.IsZero() {
+		*reply, err = e.env.Cli(args.Args)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !args.Deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), args.Deadline)
+	}
+	defer cancel()
+
+	e.cliLock.Lock()
+	if e.cliCancels == nil {
+		e.cliCancels = make(map[uint64]context.CancelFunc)
+	}
+	e.cliCancels[args.Id] = cancel
+	e.cliLock.Unlock()
+
+	defer func() {
+		e.cliLock.Lock()
+		delete(e.cliCancels, args.Id)
+		e.cliLock.Unlock()
+	}()
+
+	*reply, err = e.cli(ctx, args.Args)
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("[INFO] Environment.Cli deadline passed")
+		*reply, err = CliTimeoutExitCode, nil
+	}
+
 	return
 }
 
+// cli runs the environment's Cli until the context is done. Environments
+// that can't be cancelled are left running in the background once it is,
+// so their command may still finish and have effects later.
+func (e *EnvironmentServer) cli(ctx context.Context, args []string) (int, error) {
+	if cc, ok := e.env.(CliContexter); ok {
+		return cc.CliContext(ctx, args)
+	}
+
+	type cliResult struct {
+		code int
+		err  error
+	}
+
+	resultCh := make(chan cliResult, 1)
+	go func() {
+		code, err := e.env.Cli(args)
+		resultCh <- cliResult{code, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.code, r.err
+	case <-ctx.Done():
+		log.Printf("[WARN] Environment.Cli can't be cancelled, abandoning it: %#v", args)
+		return 1, ctx.Err()
+	}
+}
+
+// CancelCli cancels the context of the Cli call with the given ID. See
+// CliContexter for what that does to the command.
+func (e *EnvironmentServer) CancelCli(id uint64, reply *interface{}) error {
+	e.cliLock.Lock()
+	cancel, ok := e.cliCancels[id]
+	e.cliLock.Unlock()
+
+	if ok {
+		cancel()
+	}
+
+	*reply = nil
+	return nil
+}
+
 func (e *EnvironmentServer) Hook(name string, reply *uint32) error {
 	hook, err := e.env.Hook(name)
 	if err != nil {
 		return NewBasicError(err)
 	}
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterHook(hook)
-	go server.Serve()
+	// See Builder for why a nil hook isn't served.
+	if hook == nil {
+		return NewBasicError(fmt.Errorf("no hook named %q", name))
+	}
+
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterHook(hook)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
 
@@ -162,10 +386,19 @@ func (e *EnvironmentServer) PostProcessor(name string, reply *uint32) error {
 		return NewBasicError(err)
 	}
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterPostProcessor(pp)
-	go server.Serve()
+	// See Builder for why a nil post-processor isn't served.
+	if pp == nil {
+		return NewBasicError(fmt.Errorf("no post-processor named %q", name))
+	}
+
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterPostProcessor(pp)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
 
@@ -175,19 +408,32 @@ func (e *EnvironmentServer) Provisioner(name string, reply *uint32) error {
 		return NewBasicError(err)
 	}
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterProvisioner(prov)
-	go server.Serve()
+	// See Builder for why a nil provisioner isn't served.
+	if prov == nil {
+		return NewBasicError(fmt.Errorf("no provisioner named %q", name))
+	}
+
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterProvisioner(prov)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
 
 func (e *EnvironmentServer) Ui(args *interface{}, reply *uint32) error {
 	ui := e.env.Ui()
 
-	*reply = e.mux.NextId()
-	server := newServerWithMux(e.mux, *reply)
-	server.RegisterUi(ui)
-	go server.Serve()
+	id, err := serveOnMux(e.mux, func(s *Server) {
+		s.RegisterUi(ui)
+	})
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = id
 	return nil
 }
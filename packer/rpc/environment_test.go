@@ -1,9 +1,16 @@
 package rpc
 
 import (
+	"context"
+	"fmt"
 	"github.com/mitchellh/packer/packer"
+	"io"
+	"net/rpc"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testEnvBuilder = &packer.MockBuilder{}
@@ -68,7 +75,7 @@ func TestEnvironmentRPC(t *testing.T) {
 	e := &testEnvironment{}
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterEnvironment(e)
@@ -108,6 +115,24 @@ func TestEnvironmentRPC(t *testing.T) {
 		t.Fatalf("bad: %#v", result)
 	}
 
+	// Test Hook
+	_, _ = eClient.Hook("foo")
+	if !e.hookCalled {
+		t.Fatal("should be called")
+	}
+	if e.hookName != "foo" {
+		t.Fatalf("bad: %s", e.hookName)
+	}
+
+	// Test PostProcessor
+	_, _ = eClient.PostProcessor("foo")
+	if !e.ppCalled {
+		t.Fatal("should be called")
+	}
+	if e.ppName != "foo" {
+		t.Fatalf("bad: %s", e.ppName)
+	}
+
 	// Test Provisioner
 	_, _ = eClient.Provisioner("foo")
 	if !e.provCalled {
@@ -133,6 +158,447 @@ func TestEnvironmentRPC(t *testing.T) {
 	}
 }
 
+// missingEnvironment is an environment that doesn't know about any
+// builders, provisioners or post-processors.
+type missingEnvironment struct {
+	testEnvironment
+}
+
+func (e *missingEnvironment) Builder(name string) (packer.Builder, error) {
+	return nil, nil
+}
+
+func (e *missingEnvironment) PostProcessor(name string) (packer.PostProcessor, error) {
+	return nil, fmt.Errorf("No post processor found for name: %s", name)
+}
+
+func (e *missingEnvironment) Provisioner(name string) (packer.Provisioner, error) {
+	return nil, fmt.Errorf("No provisioner returned for name: %s", name)
+}
+
+func TestEnvironmentRPC_missingComponent(t *testing.T) {
+	e := new(missingEnvironment)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment()
+
+	builder, err := eClient.Builder("baz")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if builder != nil {
+		t.Fatalf("bad: %#v", builder)
+	}
+	if !strings.Contains(err.Error(), `"baz"`) {
+		t.Fatalf("bad: %s", err)
+	}
+
+	_, err = eClient.PostProcessor("foo")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if !strings.Contains(err.Error(), "foo") {
+		t.Fatalf("bad: %s", err)
+	}
+
+	_, err = eClient.Provisioner("bar")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if !strings.Contains(err.Error(), "bar") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+// nilEnvironment is an environment that returns no hooks, provisioners
+// or post-processors and no error for any name.
+type nilEnvironment struct {
+	testEnvironment
+}
+
+func (e *nilEnvironment) Hook(name string) (packer.Hook, error) {
+	return nil, nil
+}
+
+func (e *nilEnvironment) PostProcessor(name string) (packer.PostProcessor, error) {
+	return nil, nil
+}
+
+func (e *nilEnvironment) Provisioner(name string) (packer.Provisioner, error) {
+	return nil, nil
+}
+
+func TestEnvironmentRPC_nilComponent(t *testing.T) {
+	e := new(nilEnvironment)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment()
+
+	hook, err := eClient.Hook("foo")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if hook != nil {
+		t.Fatalf("bad: %#v", hook)
+	}
+	if !strings.Contains(err.Error(), `"foo"`) {
+		t.Fatalf("bad: %s", err)
+	}
+
+	pp, err := eClient.PostProcessor("bar")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if pp != nil {
+		t.Fatalf("bad: %#v", pp)
+	}
+	if !strings.Contains(err.Error(), `"bar"`) {
+		t.Fatalf("bad: %s", err)
+	}
+
+	prov, err := eClient.Provisioner("baz")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if prov != nil {
+		t.Fatalf("bad: %#v", prov)
+	}
+	if !strings.Contains(err.Error(), `"baz"`) {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestEnvironmentRPC_builderClose(t *testing.T) {
+	e := &testEnvironment{}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment()
+
+	builder, err := eClient.Builder("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	closer, ok := builder.(io.Closer)
+	if !ok {
+		t.Fatalf("bad: %#v", builder)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := builder.Prepare(nil); err != rpc.ErrShutdown {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestEnvironmentRPC_uiClose(t *testing.T) {
+	e := &testEnvironment{}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment()
+
+	// Make sure the goroutines for the connection itself are running
+	eClient.Cache()
+	before := runtime.NumGoroutine()
+
+	ui := eClient.Ui()
+	ui.Say("format")
+	if err := ui.(io.Closer).Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Closing the Ui stops the server that was serving it
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
+
+func TestEnvironmentRPC_uiClosedConn(t *testing.T) {
+	e := &testEnvironment{}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment()
+
+	// The remote environment going away doesn't panic, and the Ui can
+	// still be used
+	server.Close()
+	ui := eClient.Ui()
+	ui.Say("foo")
+	ui.Message("foo")
+	ui.Error("foo")
+	ui.Machine("foo", "bar")
+	if _, err := ui.Ask("foo?"); err == nil {
+		t.Fatal("should have error")
+	}
+	if err := ui.(io.Closer).Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestEnvironmentServer_closedConn(t *testing.T) {
+	clientConn, serverConn := TestConn(t)
+	defer clientConn.Close()
+
+	mux := NewMuxConn(serverConn)
+	mux.Close()
+	<-mux.doneCh
+
+	e := &EnvironmentServer{env: new(testEnvironment), mux: mux}
+
+	var id uint32
+	if err := e.Builder("foo", &id); err == nil {
+		t.Fatal("should have error")
+	}
+	if err := e.Ui(nil, &id); err == nil {
+		t.Fatal("should have error")
+	}
+	if id != 0 {
+		t.Fatalf("bad: %d", id)
+	}
+}
+
+// cancelEnvironment is an environment whose Cli blocks until it is
+// cancelled.
+type cancelEnvironment struct {
+	testEnvironment
+	cancelCh chan struct{}
+}
+
+func (e *cancelEnvironment) CliContext(ctx context.Context, args []string) (int, error) {
+	<-ctx.Done()
+	close(e.cancelCh)
+	return 1, ctx.Err()
+}
+
+func TestEnvironmentRPC_cliContext(t *testing.T) {
+	e := &cancelEnvironment{cancelCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+	eClient := client.Environment().(*Environment)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	code, err := eClient.CliContext(ctx, []string{"foo"})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err: %s", err)
+	}
+	if code != CliTimeoutExitCode {
+		t.Fatalf("bad: %d", code)
+	}
+
+	select {
+	case <-e.cancelCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote Cli should be cancelled")
+	}
+}
+
+// stopCommand is a command that runs until its context is done.
+type stopCommand struct {
+	stoppedCh chan struct{}
+}
+
+func (*stopCommand) Help() string     { return "" }
+func (*stopCommand) Synopsis() string { return "" }
+
+func (c *stopCommand) Run(env packer.Environment, args []string) int {
+	return c.RunContext(context.Background(), env, args)
+}
+
+func (c *stopCommand) RunContext(ctx context.Context, env packer.Environment, args []string) int {
+	<-ctx.Done()
+	close(c.stoppedCh)
+	return 1
+}
+
+func TestEnvironmentRPC_cliContextCore(t *testing.T) {
+	command := &stopCommand{stoppedCh: make(chan struct{})}
+	config := packer.DefaultEnvironmentConfig()
+	config.Commands = []string{"foo"}
+	config.Components.Command = func(string) (packer.Command, error) { return command, nil }
+	env, err := packer.NewEnvironment(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(env)
+	eClient := client.Environment().(*Environment)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	code, err := eClient.CliContext(ctx, []string{"foo"})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err: %s", err)
+	}
+	if code != CliTimeoutExitCode {
+		t.Fatalf("bad: %d", code)
+	}
+
+	select {
+	case <-command.stoppedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote command should be stopped")
+	}
+}
+
+type slowEnvironment struct {
+	testEnvironment
+	doneCh chan struct{}
+}
+
+func (e *slowEnvironment) Cli(args []string) (int, error) {
+	<-e.doneCh
+	return 0, nil
+}
+
+func TestEnvironmentRPC_callTimeout(t *testing.T) {
+	e := &slowEnvironment{doneCh: make(chan struct{})}
+	defer close(e.doneCh)
+
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+
+	eClient := client.Environment().(*Environment)
+	eClient.CallTimeout = 50 * time.Millisecond
+
+	if _, err := eClient.Cli(nil); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+// slowBuilderEnvironment is an environment whose Builder blocks until
+// doneCh is closed.
+type slowBuilderEnvironment struct {
+	testEnvironment
+	doneCh chan struct{}
+}
+
+func (e *slowBuilderEnvironment) Builder(name string) (packer.Builder, error) {
+	<-e.doneCh
+	return e.testEnvironment.Builder(name)
+}
+
+func TestEnvironmentRPC_callTimeoutStream(t *testing.T) {
+	e := &slowBuilderEnvironment{doneCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterEnvironment(e)
+
+	eClient := client.Environment().(*Environment)
+	eClient.CallTimeout = 50 * time.Millisecond
+
+	// Make sure the goroutines for the connection itself are running
+	eClient.Cache()
+	before := runtime.NumGoroutine()
+
+	if _, err := eClient.Builder("foo"); err == nil {
+		t.Fatal("should have error")
+	}
+	close(e.doneCh)
+
+	// The builder served after the timeout is closed again
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
+
+func TestEnvironmentServerCli_deadline(t *testing.T) {
+	e := &cancelEnvironment{cancelCh: make(chan struct{})}
+	server := &EnvironmentServer{env: e}
+
+	var code int
+	args := &EnvironmentCliArgs{
+		Args:     []string{"foo"},
+		Deadline: time.Now().Add(50 * time.Millisecond),
+	}
+	if err := server.Cli(args, &code); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code != CliTimeoutExitCode {
+		t.Fatalf("bad: %d", code)
+	}
+
+	select {
+	case <-e.cancelCh:
+	default:
+		t.Fatal("Cli should be cancelled")
+	}
+}
+
+func TestEnvironmentServerCli_deadlineNoContext(t *testing.T) {
+	// The environment can't be cancelled, so its Cli keeps running after
+	// the deadline until doneCh is closed. Only the call gives up.
+	e := &slowEnvironment{doneCh: make(chan struct{})}
+	defer close(e.doneCh)
+	server := &EnvironmentServer{env: e}
+
+	var code int
+	args := &EnvironmentCliArgs{
+		Args:     []string{"foo"},
+		Deadline: time.Now().Add(50 * time.Millisecond),
+	}
+	if err := server.Cli(args, &code); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code != CliTimeoutExitCode {
+		t.Fatalf("bad: %d", code)
+	}
+}
+
+func TestTestEnvironmentClient(t *testing.T) {
+	e := &testEnvironment{}
+	eClient := TestEnvironmentClient(t, e)
+
+	builder, err := eClient.Builder("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := builder.Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if code, err := eClient.Cli([]string{"foo"}); err != nil || code != 42 {
+		t.Fatalf("bad: %d %s", code, err)
+	}
+
+	eClient.Ui().Say("format")
+	if !e.builderCalled || !e.cliCalled || !e.uiCalled {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
 func TestEnvironment_ImplementsEnvironment(t *testing.T) {
 	var _ packer.Environment = new(Environment)
 }
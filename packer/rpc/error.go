@@ -1,17 +1,82 @@
 package rpc
 
+import (
+	"errors"
+	"net/rpc"
+	"strings"
+)
+
 // This is a type that wraps error types so that they can be messaged
 // across RPC channels. Since "error" is an interface, we can't always
 // gob-encode the underlying structure. This is a valid error interface
 // implementer that we will push across.
+//
+// The message and a few well-known flags, such as whether the error is
+// retryable, survive the trip. Whatever the original error type was, the
+// other side will always see a *BasicError, so arbitrary error types
+// degrade to their message and flags. Errors returned directly from an
+// RPC method rather than in a reply are turned into an rpc.ServerError
+// by net/rpc, which only keeps the message.
 type BasicError struct {
 	Message string
+	Flags   ErrorFlags
+}
+
+// ErrorFlags are the well-known properties of an error that a BasicError
+// carries across RPC.
+type ErrorFlags uint
+
+const (
+	// ErrorRetryable is set for errors that implement RetryableError
+	// and say that they are retryable.
+	ErrorRetryable ErrorFlags = 1 << iota
+)
+
+// RetryableError is implemented by errors that may go away if the action
+// is tried again, such as a cloud API throttling requests. A BasicError
+// made from one implements it as well.
+type RetryableError interface {
+	error
+	Retryable() bool
 }
 
 func NewBasicError(err error) *BasicError {
-	return &BasicError{err.Error()}
+	var flags ErrorFlags
+	var rerr RetryableError
+	if errors.As(err, &rerr) && rerr.Retryable() {
+		flags |= ErrorRetryable
+	}
+
+	return &BasicError{Message: err.Error(), Flags: flags}
 }
 
 func (e *BasicError) Error() string {
 	return e.Message
 }
+
+// Retryable returns true if the original error was retryable.
+func (e *BasicError) Retryable() bool {
+	return e.Flags&ErrorRetryable != 0
+}
+
+// IsRetryable returns true if the error, or any error it wraps, says that
+// it is retryable, including an error from the other side of an RPC
+// connection.
+func IsRetryable(err error) bool {
+	var rerr RetryableError
+	return errors.As(err, &rerr) && rerr.Retryable()
+}
+
+// isMissingMethod returns true if the error is from calling a method, or
+// a whole service such as Control, that the other side doesn't have,
+// which is the case for plugins and hosts built before it existed.
+//
+// Calls that may hit a missing method must not send a nil interface as
+// their argument, even if it is unused. The other side can't skip over
+// an argument whose type it doesn't know, so the connection hangs
+// instead of this error coming back. Send a concrete value such as true.
+func isMissingMethod(err error) bool {
+	serr, ok := err.(rpc.ServerError)
+	return ok && (strings.HasPrefix(string(serr), "rpc: can't find method") ||
+		strings.HasPrefix(string(serr), "rpc: can't find service"))
+}
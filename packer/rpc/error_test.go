@@ -1,14 +1,34 @@
 package rpc
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"github.com/mitchellh/packer/packer"
+	"net/rpc"
 	"testing"
 )
 
+// retryableError is an error type that only this package knows about.
+type retryableError string
+
+func (e retryableError) Error() string {
+	return string(e)
+}
+
+func (e retryableError) Retryable() bool {
+	return true
+}
+
 func TestBasicError_ImplementsError(t *testing.T) {
 	var _ error = new(BasicError)
 }
 
+func TestBasicError_ImplementsRetryableError(t *testing.T) {
+	var _ RetryableError = new(BasicError)
+}
+
 func TestBasicError_MatchesMessage(t *testing.T) {
 	err := errors.New("foo")
 	wrapped := NewBasicError(err)
@@ -16,4 +36,76 @@ func TestBasicError_MatchesMessage(t *testing.T) {
 	if wrapped.Error() != err.Error() {
 		t.Fatalf("bad: %#v", wrapped.Error())
 	}
+	if wrapped.Retryable() {
+		t.Fatal("should not be retryable")
+	}
+}
+
+func TestBasicError_gob(t *testing.T) {
+	// Errors are sent in reply fields of the error interface type
+	type reply struct {
+		Error error
+	}
+
+	err := fmt.Errorf("wrapped: %w", retryableError("throttled"))
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&reply{NewBasicError(err)}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var r reply
+	if err := gob.NewDecoder(&buf).Decode(&r); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if r.Error.Error() != "wrapped: throttled" {
+		t.Fatalf("bad: %s", r.Error)
+	}
+	if !IsRetryable(r.Error) {
+		t.Fatal("should be retryable")
+	}
+}
+
+// retryBuilder is a builder whose Prepare fails with a retryable error.
+type retryBuilder struct {
+	packer.MockBuilder
+}
+
+func (b *retryBuilder) Prepare(config ...interface{}) ([]string, error) {
+	return nil, retryableError("throttled")
+}
+
+func TestBasicError_retryableRPC(t *testing.T) {
+	b := TestBuilderClient(t, new(retryBuilder))
+
+	_, err := b.Prepare(nil)
+	if err == nil || err.Error() != "throttled" {
+		t.Fatalf("err: %v", err)
+	}
+	if !IsRetryable(err) {
+		t.Fatal("should be retryable")
+	}
+	if IsRetryable(errors.New("foo")) {
+		t.Fatal("should not be retryable")
+	}
+}
+
+func TestIsMissingMethod(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{rpc.ServerError("rpc: can't find method Builder.Foo"), true},
+		{rpc.ServerError("rpc: can't find service Control.Ping"), true},
+		{rpc.ServerError("foo"), false},
+		{errors.New("rpc: can't find method Builder.Foo"), false},
+		{nil, false},
+	}
+
+	for _, tc := range cases {
+		if actual := isMissingMethod(tc.err); actual != tc.expected {
+			t.Fatalf("bad: %v %t", tc.err, actual)
+		}
+	}
 }
@@ -42,6 +42,27 @@ func (h *hook) Run(name string, ui packer.Ui, comm packer.Communicator, data int
 	return h.client.Call("Hook.Run", &args, new(interface{}))
 }
 
+// Artifact serves the artifact and sends it to the hook on the other
+// side, which is usually the host reporting it to the user.
+func (h *hook) Artifact(a packer.Artifact) {
+	nextId := h.mux.NextId()
+	server := newServerWithMux(h.mux, nextId)
+	server.RegisterArtifact(a)
+	go server.Serve()
+
+	err := h.client.Call("Hook.Artifact", nextId, new(interface{}))
+	if err != nil {
+		// The other side won't connect to the artifact, so stop serving it
+		h.mux.cancelAccept(nextId)
+	}
+
+	// Hosts built before Artifact existed just don't hear about it, the
+	// same as before.
+	if err != nil && !isMissingMethod(err) {
+		log.Printf("Hook.Artifact error: %s", err)
+	}
+}
+
 func (h *hook) Cancel() {
 	err := h.client.Call("Hook.Cancel", new(interface{}), new(interface{}))
 	if err != nil {
@@ -50,16 +71,38 @@ func (h *hook) Cancel() {
 }
 
 func (h *HookServer) Run(args *HookRunArgs, reply *interface{}) error {
+	if err := h.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer h.mux.calls.done()
+
 	client, err := newClientWithMux(h.mux, args.StreamId)
 	if err != nil {
 		return NewBasicError(err)
 	}
 	defer client.Close()
 
-	if err := h.hook.Run(args.Name, client.Ui(), client.Communicator(), args.Data); err != nil {
+	ui := client.Ui().(*Ui)
+	defer ui.Close()
+
+	if err := h.hook.Run(args.Name, ui, client.Communicator(), args.Data); err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = nil
+	return nil
+}
+
+func (h *HookServer) Artifact(streamId uint32, reply *interface{}) error {
+	client, err := newClientWithMux(h.mux, streamId)
+	if err != nil {
 		return NewBasicError(err)
 	}
 
+	defer client.Close()
+
+	packer.ReportArtifact(h.hook, client.Artifact())
+
 	*reply = nil
 	return nil
 }
@@ -3,6 +3,7 @@ package rpc
 import (
 	"github.com/mitchellh/packer/packer"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -13,7 +14,7 @@ func TestHookRPC(t *testing.T) {
 	h := new(packer.MockHook)
 
 	// Serve
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterHook(h)
@@ -33,6 +34,75 @@ func TestHookRPC(t *testing.T) {
 	}
 }
 
+func TestHookRPC_artifactClose(t *testing.T) {
+	h := &artifactHook{artifactCh: make(chan string, 1)}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterHook(h)
+	hClient := client.Hook()
+
+	// Make sure the goroutines for the connection itself are running
+	hClient.Cancel()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		packer.ReportArtifact(hClient, &packer.MockArtifact{IdValue: "foo"})
+		if id := <-h.artifactCh; id != "foo" {
+			t.Fatalf("bad: %s", id)
+		}
+	}
+
+	// Reporting an artifact doesn't leave its server running
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
+
+// oldHookServer is a hook server from before Artifact existed.
+type oldHookServer struct {
+	server *HookServer
+}
+
+func (s *oldHookServer) Cancel(args *interface{}, reply *interface{}) error {
+	return s.server.Cancel(args, reply)
+}
+
+func TestHookRPC_artifactOldHost(t *testing.T) {
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultHookEndpoint, &oldHookServer{
+		server: &HookServer{hook: new(packer.MockHook), mux: server.mux},
+	})
+	hClient := client.Hook()
+
+	// Make sure the goroutines for the connection itself are running
+	hClient.Cancel()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		packer.ReportArtifact(hClient, &packer.MockArtifact{IdValue: "foo"})
+	}
+
+	// The artifact servers that were never connected to are stopped
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
+
 func TestHook_Implements(t *testing.T) {
 	var _ packer.Hook = new(hook)
 }
@@ -53,7 +123,7 @@ func TestHook_cancelWhileRun(t *testing.T) {
 	}
 
 	// Serve
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterHook(h)
@@ -3,8 +3,23 @@ package rpc
 import "encoding/gob"
 
 func init() {
-	gob.Register(new(map[string]interface{}))
-	gob.Register(new(map[string]string))
-	gob.Register(make([]interface{}, 0))
+	// Configs decoded from JSON are made of these types. They're registered
+	// as values rather than pointers so that they decode as the same types
+	// they were encoded as. Gob already knows about the basic types such as
+	// float64, bool and string.
+	gob.Register(map[string]interface{}{})
+	gob.Register(map[string]string{})
+	gob.Register([]interface{}{})
 	gob.Register(new(BasicError))
 }
+
+// RegisterBuilderConfig registers the concrete type of a value that is
+// passed to a builder's Prepare across RPC, so that the builder receives
+// the value with its full type instead of failing to decode it.
+//
+// Gob needs the type registered in both processes, so this must be
+// called by the host as well as the plugin, usually from an init
+// function in a package that both import.
+func RegisterBuilderConfig(value interface{}) {
+	gob.Register(value)
+}
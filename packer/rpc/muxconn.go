@@ -30,6 +30,22 @@ type MuxConn struct {
 	muDial        sync.RWMutex
 	wlock         sync.Mutex
 	doneCh        chan struct{}
+
+	// calls tracks the long running calls served on this connection
+	// so that they can be drained with Control.Shutdown.
+	calls callTracker
+
+	// requestIds is true if the RPC clients and servers on this
+	// connection send and log request IDs. See RequestIdsEnvVar.
+	requestIds bool
+
+	// observer, if set, is told about the calls made by the RPC
+	// clients on this connection.
+	observer CallObserver
+
+	// secrets is how the plugin end of the connection gets to the
+	// secrets served by the host. See Client.ServeSecrets.
+	secrets secretsConn
 }
 
 type muxPacketFrom byte
@@ -66,6 +82,7 @@ func NewMuxConn(rwc io.ReadWriteCloser) *MuxConn {
 		streamsAccept: make(map[uint32]*Stream),
 		streamsDial:   make(map[uint32]*Stream),
 		doneCh:        make(chan struct{}),
+		requestIds:    requestIdsEnabled(),
 	}
 
 	go m.cleaner()
@@ -97,6 +114,17 @@ func (m *MuxConn) Close() error {
 	return m.rwc.Close()
 }
 
+// closed returns true once the underlying connection is closed, after
+// which no more streams can be opened.
+func (m *MuxConn) closed() bool {
+	select {
+	case <-m.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // Accept accepts a multiplexed connection with the given ID. This
 // will block until a request is made to connect.
 func (m *MuxConn) Accept(id uint32) (io.ReadWriteCloser, error) {
@@ -115,6 +143,10 @@ func (m *MuxConn) Accept(id uint32) (io.ReadWriteCloser, error) {
 	stream.mu.Lock()
 	defer stream.mu.Unlock()
 
+	if stream.cancelled {
+		return nil, fmt.Errorf("Accept on stream %d was cancelled", id)
+	}
+
 	// If the stream isn't closed, then it is already open somehow
 	if stream.state != streamStateSynRecv && stream.state != streamStateClosed {
 		panic(fmt.Sprintf(
@@ -143,6 +175,32 @@ func (m *MuxConn) Accept(id uint32) (io.ReadWriteCloser, error) {
 	return stream, nil
 }
 
+// cancelAccept makes an Accept with the given ID that is still waiting
+// for the other end to connect return an error, including one that
+// hasn't been called yet. This is for streams that the other end may
+// never connect to. A stream that is already connected is left alone.
+func (m *MuxConn) cancelAccept(id uint32) {
+	m.muAccept.Lock()
+	stream, ok := m.streamsAccept[id]
+	if !ok {
+		stream = newStream(muxPacketFromAccept, id, m)
+		m.streamsAccept[id] = stream
+	}
+	m.muAccept.Unlock()
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if stream.state != streamStateClosed && stream.state != streamStateListen {
+		return
+	}
+
+	// Nothing will ever be read from the stream, so its writer can stop
+	stream.cancelled = true
+	stream.closeWriter()
+	stream.setState(streamStateClosed)
+}
+
 // Dial opens a connection to the remote end using the given stream ID.
 // An Accept on the remote end will only work with if the IDs match.
 func (m *MuxConn) Dial(id uint32) (io.ReadWriteCloser, error) {
@@ -465,6 +523,9 @@ type Stream struct {
 	stateUpdated time.Time
 	mu           sync.Mutex
 	writeCh      chan<- []byte
+
+	// cancelled is set by cancelAccept to make Accept give up.
+	cancelled bool
 }
 
 type streamState byte
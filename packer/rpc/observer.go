@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// CallObserver is told about every call a Client makes once its reply
+// arrives, for example to record how long calls take as metrics. It is
+// called from the goroutine that reads replies, so it must not block.
+type CallObserver interface {
+	OnCall(method string, d time.Duration, err error)
+}
+
+// NewClientWithObserver is like NewClient, but every call made by the
+// client, and by the clients of the components it returns, is reported
+// to the observer.
+func NewClientWithObserver(rwc io.ReadWriteCloser, o CallObserver) (*Client, error) {
+	mux := NewMuxConn(rwc)
+	mux.observer = o
+
+	result, err := newClientWithMux(mux, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result.closeMux = true
+	return result, err
+}
+
+// observedCall is a call in progress on an observingClientCodec.
+type observedCall struct {
+	method string
+	start  time.Time
+}
+
+// observingClientCodec wraps a codec to time the calls made with it.
+type observingClientCodec struct {
+	rpc.ClientCodec
+	observer CallObserver
+
+	l       sync.Mutex
+	pending map[uint64]observedCall
+}
+
+func newObservingClientCodec(codec rpc.ClientCodec, o CallObserver) *observingClientCodec {
+	return &observingClientCodec{
+		ClientCodec: codec,
+		observer:    o,
+		pending:     make(map[uint64]observedCall),
+	}
+}
+
+func (c *observingClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	c.l.Lock()
+	c.pending[r.Seq] = observedCall{method: r.ServiceMethod, start: time.Now()}
+	c.l.Unlock()
+
+	return c.ClientCodec.WriteRequest(r, body)
+}
+
+func (c *observingClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.ClientCodec.ReadResponseHeader(r); err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	call, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+
+	if ok {
+		var err error
+		if r.Error != "" {
+			err = errors.New(r.Error)
+		}
+
+		c.observer.OnCall(call.method, time.Since(call.start), err)
+	}
+
+	return nil
+}
+
+// gobClientCodec is the same codec that net/rpc uses by default, which
+// isn't exported so that it can be wrapped.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(rwc io.ReadWriteCloser) *gobClientCodec {
+	encBuf := bufio.NewWriter(rwc)
+	return &gobClientCodec{
+		rwc:    rwc,
+		dec:    gob.NewDecoder(rwc),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCallObserver struct {
+	l       sync.Mutex
+	methods []string
+	errs    []error
+}
+
+func (o *testCallObserver) OnCall(method string, d time.Duration, err error) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	o.methods = append(o.methods, method)
+	o.errs = append(o.errs, err)
+}
+
+func TestNewClientWithObserver(t *testing.T) {
+	clientConn, serverConn := TestConn(t)
+
+	server := NewServer(serverConn)
+	defer server.Close()
+	go server.Serve()
+
+	b := new(packer.MockBuilder)
+	server.RegisterBuilder(b)
+
+	o := new(testCallObserver)
+	client, err := NewClientWithObserver(clientConn, o)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer client.Close()
+
+	bClient := client.Builder()
+	if _, err := bClient.Prepare(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b.RunErrResult = true
+	if _, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache)); err == nil {
+		t.Fatal("should have error")
+	}
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if len(o.methods) != 2 || o.methods[0] != "Builder.Prepare" || o.methods[1] != "Builder.Run" {
+		t.Fatalf("bad: %#v", o.methods)
+	}
+	if o.errs[0] != nil {
+		t.Fatalf("bad: %s", o.errs[0])
+	}
+	if o.errs[1] == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -77,14 +77,22 @@ func (p *PostProcessorServer) Configure(args *PostProcessorConfigureArgs, reply
 }
 
 func (p *PostProcessorServer) PostProcess(streamId uint32, reply *PostProcessorProcessResponse) error {
+	if err := p.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer p.mux.calls.done()
+
 	client, err := newClientWithMux(p.mux, streamId)
 	if err != nil {
 		return NewBasicError(err)
 	}
 	defer client.Close()
 
+	ui := client.Ui().(*Ui)
+	defer ui.Close()
+
 	streamId = 0
-	artifactResult, keep, err := p.p.PostProcess(client.Ui(), client.Artifact())
+	artifactResult, keep, err := p.p.PostProcess(ui, client.Artifact())
 	if err == nil && artifactResult != nil {
 		streamId = p.mux.NextId()
 		server := newServerWithMux(p.mux, streamId)
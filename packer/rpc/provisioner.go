@@ -60,13 +60,21 @@ func (p *ProvisionerServer) Prepare(args *ProvisionerPrepareArgs, reply *error)
 }
 
 func (p *ProvisionerServer) Provision(streamId uint32, reply *interface{}) error {
+	if err := p.mux.calls.start(); err != nil {
+		return NewBasicError(err)
+	}
+	defer p.mux.calls.done()
+
 	client, err := newClientWithMux(p.mux, streamId)
 	if err != nil {
 		return NewBasicError(err)
 	}
 	defer client.Close()
 
-	if err := p.p.Provision(client.Ui(), client.Communicator()); err != nil {
+	ui := client.Ui().(*Ui)
+	defer ui.Close()
+
+	if err := p.p.Provision(ui, client.Communicator()); err != nil {
 		return NewBasicError(err)
 	}
 
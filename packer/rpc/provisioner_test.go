@@ -11,7 +11,7 @@ func TestProvisionerRPC(t *testing.T) {
 	p := new(packer.MockProvisioner)
 
 	// Start the server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterProvisioner(p)
@@ -0,0 +1,182 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// RequestIdsEnvVar is the environment variable that turns on request IDs.
+// When it is set, every call made on a connection is given an ID that is
+// sent along with the call and logged on both ends, so a single call
+// can be followed from the host into a plugin and back in the logs.
+//
+// Both ends of a connection must agree on this since the ID is part of
+// what is sent over the wire. Plugins inherit the environment of the
+// host that starts them, so setting it for the host is enough.
+const RequestIdsEnvVar = "PACKER_RPC_REQUEST_IDS"
+
+// requestIdCount is used to make request IDs unique within this process.
+// The process ID is added so that they're unique across the host and
+// its plugins as well.
+var requestIdCount uint64
+
+func requestIdsEnabled() bool {
+	return os.Getenv(RequestIdsEnvVar) != ""
+}
+
+func newRequestId() string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&requestIdCount, 1))
+}
+
+// requestIdCall is a call in progress on one of the request ID codecs.
+type requestIdCall struct {
+	id     string
+	method string
+}
+
+// requestIdClientCodec is like the gob codec that net/rpc uses by
+// default, except that every request is followed by its request ID.
+type requestIdClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	l       sync.Mutex
+	pending map[uint64]requestIdCall
+}
+
+func newRequestIdClientCodec(rwc io.ReadWriteCloser) *requestIdClientCodec {
+	encBuf := bufio.NewWriter(rwc)
+	return &requestIdClientCodec{
+		rwc:     rwc,
+		dec:     gob.NewDecoder(rwc),
+		enc:     gob.NewEncoder(encBuf),
+		encBuf:  encBuf,
+		pending: make(map[uint64]requestIdCall),
+	}
+}
+
+func (c *requestIdClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	call := requestIdCall{id: newRequestId(), method: r.ServiceMethod}
+	log.Printf("[DEBUG] rpc: request %s: calling %s", call.id, call.method)
+
+	c.l.Lock()
+	c.pending[r.Seq] = call
+	c.l.Unlock()
+
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(call.id); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *requestIdClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	call, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+
+	if ok {
+		log.Printf("[DEBUG] rpc: request %s: %s returned", call.id, call.method)
+	}
+
+	return nil
+}
+
+func (c *requestIdClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *requestIdClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// requestIdServerCodec is the server end of requestIdClientCodec.
+type requestIdServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	l       sync.Mutex
+	pending map[uint64]requestIdCall
+}
+
+func newRequestIdServerCodec(rwc io.ReadWriteCloser) *requestIdServerCodec {
+	encBuf := bufio.NewWriter(rwc)
+	return &requestIdServerCodec{
+		rwc:     rwc,
+		dec:     gob.NewDecoder(rwc),
+		enc:     gob.NewEncoder(encBuf),
+		encBuf:  encBuf,
+		pending: make(map[uint64]requestIdCall),
+	}
+}
+
+func (c *requestIdServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+
+	call := requestIdCall{method: r.ServiceMethod}
+	if err := c.dec.Decode(&call.id); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] rpc: request %s: serving %s", call.id, call.method)
+
+	c.l.Lock()
+	c.pending[r.Seq] = call
+	c.l.Unlock()
+
+	return nil
+}
+
+func (c *requestIdServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *requestIdServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.l.Lock()
+	call, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+
+	if ok {
+		log.Printf("[DEBUG] rpc: request %s: finished %s", call.id, call.method)
+	}
+
+	// net/rpc serializes calls to WriteResponse, so this doesn't need
+	// to take the lock.
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+
+	return c.encBuf.Flush()
+}
+
+func (c *requestIdServerCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"bytes"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to log to from many
+// goroutines while it is being read.
+type syncBuffer struct {
+	buf bytes.Buffer
+	l   sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestIds(t *testing.T) {
+	os.Setenv(RequestIdsEnvVar, "1")
+	defer os.Unsetenv(RequestIdsEnvVar)
+
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+	bClient := client.Builder()
+
+	if _, err := bClient.Prepare(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Calls that call back into the host still work
+	if _, err := bClient.Run(new(testUi), new(packer.MockHook), new(testCache)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The same ID is logged by the client and the server
+	re := regexp.MustCompile(`request (\S+): calling Builder.Prepare`)
+	match := re.FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("bad: %s", logs.String())
+	}
+
+	for _, action := range []string{"serving", "finished"} {
+		expected := "request " + match[1] + ": " + action + " Builder.Prepare"
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("missing %q: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestRequestIds_disabled(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	b := new(packer.MockBuilder)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(b)
+
+	if _, err := client.Builder().Prepare(42); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if regexp.MustCompile(`rpc: request`).MatchString(logs.String()) {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
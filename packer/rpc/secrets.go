@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoSecrets is returned by Server.Secrets if the host doesn't serve
+// any secrets.
+var ErrNoSecrets = errors.New("the host doesn't serve any secrets")
+
+// SecretsProvider provides the secrets, such as cloud credentials, that a
+// host hands to its plugins when they ask for them. Passing secrets this
+// way rather than in the plugin's environment keeps them out of places
+// that other users of the machine can read, like /proc. The connection
+// should be protected with TLS for the same reason.
+type SecretsProvider interface {
+	Secrets() (map[string]string, error)
+}
+
+// SecretsServer wraps a SecretsProvider and makes it exportable as part
+// of a Golang RPC server.
+type SecretsServer struct {
+	p SecretsProvider
+}
+
+// secretsConn is the plugin end of the secrets served by the host. The
+// host tells the plugin which stream they are on, and the plugin
+// connects to it the first time they are asked for.
+type secretsConn struct {
+	l        sync.Mutex
+	streamId uint32
+	client   *Client
+}
+
+// ServeSecrets serves the secrets from the provider to the other end of
+// the connection, which can get them with Server.Secrets.
+func (c *Client) ServeSecrets(p SecretsProvider) error {
+	id, err := serveOnMux(c.mux, func(s *Server) {
+		s.server.RegisterName("Secrets", &SecretsServer{p: p})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.client.Call("Control.ServeSecrets", id, new(interface{}))
+	if err != nil {
+		// The other side won't connect to the secrets, so stop serving them
+		c.mux.cancelAccept(id)
+	}
+
+	return err
+}
+
+// Secrets asks the other end of the connection for its secrets.
+// ErrNoSecrets is returned if it doesn't serve any.
+func (s *Server) Secrets() (map[string]string, error) {
+	conn := &s.mux.secrets
+	conn.l.Lock()
+	defer conn.l.Unlock()
+
+	if conn.streamId == 0 {
+		return nil, ErrNoSecrets
+	}
+
+	if conn.client == nil {
+		client, err := newClientWithMux(s.mux, conn.streamId)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.client = client
+	}
+
+	// The argument is unused. See isMissingMethod for why it isn't nil.
+	var secrets map[string]string
+	if err := conn.client.client.Call("Secrets.Secrets", true, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// ServeSecrets records the stream that the host serves its secrets on.
+func (c *ControlServer) ServeSecrets(streamId uint32, reply *interface{}) error {
+	conn := &c.mux.secrets
+	conn.l.Lock()
+	defer conn.l.Unlock()
+
+	if conn.client != nil {
+		conn.client.Close()
+		conn.client = nil
+	}
+	conn.streamId = streamId
+
+	*reply = nil
+	return nil
+}
+
+func (s *SecretsServer) Secrets(args bool, reply *map[string]string) error {
+	secrets, err := s.p.Secrets()
+	if err != nil {
+		return NewBasicError(err)
+	}
+
+	*reply = secrets
+	return nil
+}
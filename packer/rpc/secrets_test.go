@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/mitchellh/packer/packer"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type testSecrets struct {
+	secrets map[string]string
+	err     error
+}
+
+func (s *testSecrets) Secrets() (map[string]string, error) {
+	return s.secrets, s.err
+}
+
+func TestServerSecrets(t *testing.T) {
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := server.Secrets(); err != ErrNoSecrets {
+		t.Fatalf("err: %v", err)
+	}
+
+	p := &testSecrets{secrets: map[string]string{"token": "hunter2"}}
+	if err := client.ServeSecrets(p); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		secrets, err := server.Secrets()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(secrets, p.secrets) {
+			t.Fatalf("bad: %#v", secrets)
+		}
+	}
+}
+
+func TestServerSecrets_error(t *testing.T) {
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+
+	p := &testSecrets{err: errors.New("vault is sealed")}
+	if err := client.ServeSecrets(p); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := server.Secrets(); err == nil || err.Error() != "vault is sealed" {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServeSecrets_oldPlugin(t *testing.T) {
+	client, server := testOldClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterBuilder(new(packer.MockBuilder))
+
+	// Make sure the goroutines for the connection itself are running
+	if _, err := client.Builder().Prepare(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	before := runtime.NumGoroutine()
+
+	p := &testSecrets{secrets: map[string]string{"token": "hunter2"}}
+	for i := 0; i < 5; i++ {
+		if err := client.ServeSecrets(p); err == nil {
+			t.Fatal("should have error")
+		}
+	}
+
+	// The secrets servers that were never connected to are stopped
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("bad: %d goroutines, %d before", runtime.NumGoroutine(), before)
+}
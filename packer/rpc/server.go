@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
 	"io"
@@ -18,6 +19,7 @@ const (
 	DefaultCacheEndpoint                = "Cache"
 	DefaultCommandEndpoint              = "Command"
 	DefaultCommunicatorEndpoint         = "Communicator"
+	DefaultControlEndpoint              = "Control"
 	DefaultEnvironmentEndpoint          = "Environment"
 	DefaultHookEndpoint                 = "Hook"
 	DefaultPostProcessorEndpoint        = "PostProcessor"
@@ -38,6 +40,9 @@ type Server struct {
 func NewServer(conn io.ReadWriteCloser) *Server {
 	result := newServerWithMux(NewMuxConn(conn), 0)
 	result.closeMux = true
+	result.server.RegisterName(DefaultControlEndpoint, &ControlServer{
+		mux: result.mux,
+	})
 	return result
 }
 
@@ -139,15 +144,36 @@ func (s *Server) Serve() {
 	// Accept a connection on stream ID 0, which is always used for
 	// normal client to server connections.
 	stream, err := s.mux.Accept(s.streamId)
-	defer stream.Close()
 	if err != nil {
 		log.Printf("[ERR] Error retrieving stream for serving: %s", err)
 		return
 	}
+	defer stream.Close()
+
+	if s.mux.requestIds {
+		s.server.ServeCodec(newRequestIdServerCodec(stream))
+		return
+	}
 
 	s.server.ServeConn(stream)
 }
 
+// serveOnMux serves the components that register adds to a server on
+// a new stream of the connection, and returns the ID of the stream for
+// the client to connect to. An error is returned if the connection is
+// already closed, since nothing could ever connect to the stream.
+func serveOnMux(mux *MuxConn, register func(*Server)) (uint32, error) {
+	if mux.closed() {
+		return 0, errors.New("can't serve component: connection is closed")
+	}
+
+	id := mux.NextId()
+	server := newServerWithMux(mux, id)
+	register(server)
+	go server.Serve()
+	return id, nil
+}
+
 // registerComponent registers a single Packer RPC component onto
 // the RPC server. If id is true, then a unique ID number will be appended
 // onto the end of the endpoint.
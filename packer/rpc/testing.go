@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"github.com/mitchellh/packer/packer"
+	"net"
+	"testing"
+)
+
+// TestConn returns a pair of connected net.Conns, the client end first.
+// This is meant for tests.
+func TestConn(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	var serverConn net.Conn
+	doneCh := make(chan error, 1)
+	go func() {
+		var err error
+		serverConn, err = l.Accept()
+		doneCh <- err
+	}()
+
+	clientConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := <-doneCh; err != nil {
+		clientConn.Close()
+		t.Fatalf("err: %s", err)
+	}
+
+	return clientConn, serverConn
+}
+
+// TestClientServer returns a connected RPC client and server, without
+// starting a plugin process. Register components on the server and get
+// them from the client to test that they work over RPC, for example that
+// their arguments can be encoded with gob:
+//
+//	client, server := rpc.TestClientServer(t)
+//	defer client.Close()
+//	defer server.Close()
+//	server.RegisterBuilder(myBuilder)
+//	client.Builder().Prepare(config)
+func TestClientServer(t *testing.T) (*Client, *Server) {
+	clientConn, serverConn := TestConn(t)
+
+	server := NewServer(serverConn)
+	go server.Serve()
+
+	client, err := NewClient(clientConn)
+	if err != nil {
+		server.Close()
+		t.Fatalf("err: %s", err)
+	}
+
+	return client, server
+}
+
+// TestBuilderClient serves the builder over a real RPC connection and
+// returns the client side of it, without starting a plugin process.
+// Host code under test can use the result like a builder from a plugin.
+// The connection is closed when the test finishes.
+func TestBuilderClient(t *testing.T, b packer.Builder) packer.Builder {
+	client, server := TestClientServer(t)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	server.RegisterBuilder(b)
+	return client.Builder()
+}
+
+// TestEnvironmentClient serves the environment over a real RPC
+// connection and returns the client side of it, without starting a
+// plugin process. The builders, Ui and Cli of the environment can then
+// be used the same way a plugin would use them. The connection is
+// closed when the test finishes.
+func TestEnvironmentClient(t *testing.T, env packer.Environment) packer.Environment {
+	client, server := TestClientServer(t)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	server.RegisterEnvironment(env)
+	return client.Environment()
+}
@@ -1,16 +1,39 @@
 package rpc
 
 import (
+	"errors"
+	"fmt"
 	"github.com/mitchellh/packer/packer"
 	"log"
 	"net/rpc"
+	"sync"
+	"time"
 )
 
+// errUiTimeout is returned by Ui.callTimeout when the call times out.
+var errUiTimeout = errors.New("ui call timed out")
+
 // An implementation of packer.Ui where the Ui is actually executed
 // over an RPC connection.
 type Ui struct {
+	// AskTimeout, if set, is how long Ask waits for the other side to
+	// answer, so that unattended runs don't hang on a question that
+	// nobody is there to answer. If it times out, Ask returns AskDefault
+	// if that is set, and an error otherwise. Whoever builds the Ui sets
+	// these, the same as for packer.BasicUi.
+	AskTimeout time.Duration
+	AskDefault string
+
 	client   *rpc.Client
 	endpoint string
+
+	// closeClient is true if the Ui has a client of its own that
+	// should be closed along with it.
+	closeClient bool
+
+	l        sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
 }
 
 // UiServer wraps a packer.Ui implementation and makes it exportable
@@ -19,19 +42,62 @@ type UiServer struct {
 	ui packer.Ui
 }
 
+// BufferedUi wraps a packer.Ui and buffers Say and Message output,
+// sending it in batches so that chatty output doesn't cost a round-trip
+// per line when the Ui is served over RPC. Buffered output is sent every
+// flush interval and before every Ask, Error, Machine and Progress call,
+// so that output stays in order. Close must be called to send the
+// remaining output.
+type BufferedUi struct {
+	ui     packer.Ui
+	buf    []UiBatchMessage
+	l      sync.Mutex
+	doneCh chan struct{}
+	once   sync.Once
+}
+
+// offlineUi is the Ui returned by Environment.Ui when the remote Ui can't
+// be reached, so that callers can go on using it. Its output is only
+// logged, and every question fails with the error from connecting.
+type offlineUi struct {
+	err error
+}
+
+// A single line of buffered output sent to Ui.Batch. It is shown with
+// Say if Say is true, otherwise with Message.
+type UiBatchMessage struct {
+	Say     bool
+	Message string
+}
+
 // The arguments sent to Ui.Machine
 type UiMachineArgs struct {
 	Category string
 	Args     []string
 }
 
-func (u *Ui) Ask(query string) (result string, err error) {
-	err = u.client.Call("Ui.Ask", query, &result)
-	return
+func (u *Ui) Ask(query string) (string, error) {
+	var timeout <-chan time.Time
+	if u.AskTimeout > 0 {
+		timeout = time.After(u.AskTimeout)
+	}
+
+	var result string
+	err := u.callTimeout("Ui.Ask", query, &result, timeout)
+	if err == errUiTimeout {
+		if u.AskDefault != "" {
+			log.Printf("ui: ask timed out, using default: %s", u.AskDefault)
+			return u.AskDefault, nil
+		}
+
+		return "", fmt.Errorf("timeout waiting for an answer after %s", u.AskTimeout)
+	}
+
+	return result, err
 }
 
 func (u *Ui) Error(message string) {
-	if err := u.client.Call("Ui.Error", message, new(interface{})); err != nil {
+	if err := u.call("Ui.Error", message, new(interface{})); err != nil {
 		log.Printf("Error in Ui RPC call: %s", err)
 	}
 }
@@ -42,28 +108,243 @@ func (u *Ui) Machine(t string, args ...string) {
 		Args:     args,
 	}
 
-	if err := u.client.Call("Ui.Machine", rpcArgs, new(interface{})); err != nil {
+	if err := u.call("Ui.Machine", rpcArgs, new(interface{})); err != nil {
 		log.Printf("Error in Ui RPC call: %s", err)
 	}
 }
 
 func (u *Ui) Message(message string) {
-	if err := u.client.Call("Ui.Message", message, new(interface{})); err != nil {
+	if err := u.call("Ui.Message", message, new(interface{})); err != nil {
+		log.Printf("Error in Ui RPC call: %s", err)
+	}
+}
+
+func (u *Ui) Progress(p packer.Progress) {
+	err := u.call("Ui.Progress", &p, new(interface{}))
+
+	// Hosts built before Progress existed don't have the method, so
+	// show the progress on them like on any Ui that can't show it. The
+	// Ui is wrapped so that only the Ui methods are seen.
+	if isMissingMethod(err) {
+		packer.ReportProgress(struct{ packer.Ui }{u}, p)
+		return
+	}
+
+	if err != nil {
 		log.Printf("Error in Ui RPC call: %s", err)
 	}
 }
 
 func (u *Ui) Say(message string) {
-	if err := u.client.Call("Ui.Say", message, new(interface{})); err != nil {
+	if err := u.call("Ui.Say", message, new(interface{})); err != nil {
 		log.Printf("Error in Ui RPC call: %s", err)
 	}
 }
 
+// Close waits for the calls that are still in flight to be acknowledged
+// by the other side, so that the last of the output isn't lost when the
+// connection is torn down, and then refuses any more calls. It is safe
+// to call multiple times.
+func (u *Ui) Close() error {
+	u.l.Lock()
+	if u.closed {
+		u.l.Unlock()
+		return nil
+	}
+	u.closed = true
+	u.l.Unlock()
+
+	u.inFlight.Wait()
+
+	if u.closeClient {
+		return u.client.Close()
+	}
+
+	return nil
+}
+
+// call makes a call on the remote Ui, keeping track of it so that Close
+// can wait for it.
+func (u *Ui) call(method string, args interface{}, reply interface{}) error {
+	return u.callTimeout(method, args, reply, nil)
+}
+
+// callTimeout is like call, but gives up and returns errUiTimeout once
+// timeout fires. The call is then no longer waited for by Close, and
+// its reply is dropped whenever it arrives.
+func (u *Ui) callTimeout(method string, args interface{}, reply interface{}, timeout <-chan time.Time) error {
+	u.l.Lock()
+	if u.closed {
+		u.l.Unlock()
+		return rpc.ErrShutdown
+	}
+	u.inFlight.Add(1)
+	u.l.Unlock()
+	defer u.inFlight.Done()
+
+	call := u.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timeout:
+		return errUiTimeout
+	}
+}
+
+func (u *offlineUi) Ask(query string) (string, error) {
+	return "", u.err
+}
+
+func (u *offlineUi) Error(message string) {
+	log.Printf("ui (offline) error: %s", message)
+}
+
+func (u *offlineUi) Machine(t string, args ...string) {
+	log.Printf("ui (offline) machine: %s %#v", t, args)
+}
+
+func (u *offlineUi) Message(message string) {
+	log.Printf("ui (offline): %s", message)
+}
+
+func (u *offlineUi) Say(message string) {
+	log.Printf("ui (offline): %s", message)
+}
+
+// Close does nothing, since there is no connection to close.
+func (u *offlineUi) Close() error {
+	return nil
+}
+
+// NewBufferedUi returns a BufferedUi that sends buffered output to ui
+// every interval.
+func NewBufferedUi(ui packer.Ui, interval time.Duration) *BufferedUi {
+	u := &BufferedUi{
+		ui:     ui,
+		doneCh: make(chan struct{}),
+	}
+
+	go u.flushLoop(interval)
+	return u
+}
+
+func (u *BufferedUi) Ask(query string) (string, error) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.flush()
+	return u.ui.Ask(query)
+}
+
+func (u *BufferedUi) Error(message string) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.flush()
+	u.ui.Error(message)
+}
+
+func (u *BufferedUi) Machine(t string, args ...string) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.flush()
+	u.ui.Machine(t, args...)
+}
+
+func (u *BufferedUi) Message(message string) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.buf = append(u.buf, UiBatchMessage{Message: message})
+}
+
+func (u *BufferedUi) Progress(p packer.Progress) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.flush()
+	packer.ReportProgress(u.ui, p)
+}
+
+func (u *BufferedUi) Say(message string) {
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.buf = append(u.buf, UiBatchMessage{Say: true, Message: message})
+}
+
+// Close sends any remaining buffered output and stops the periodic
+// flushing. It is safe to call multiple times.
+func (u *BufferedUi) Close() {
+	u.once.Do(func() {
+		close(u.doneCh)
+	})
+
+	u.l.Lock()
+	defer u.l.Unlock()
+	u.flush()
+}
+
+func (u *BufferedUi) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.l.Lock()
+			u.flush()
+			u.l.Unlock()
+		case <-u.doneCh:
+			return
+		}
+	}
+}
+
+// flush sends the buffered output. The lock must be held.
+func (u *BufferedUi) flush() {
+	if len(u.buf) == 0 {
+		return
+	}
+
+	buf := u.buf
+	u.buf = nil
+
+	// An RPC Ui can take all of the output in a single call, unless the
+	// host was built before Batch existed.
+	if rpcUi, ok := u.ui.(*Ui); ok {
+		err := rpcUi.call("Ui.Batch", buf, new(interface{}))
+		if !isMissingMethod(err) {
+			if err != nil {
+				log.Printf("Error in Ui RPC call: %s", err)
+			}
+
+			return
+		}
+	}
+
+	for _, m := range buf {
+		sendBatchMessage(u.ui, m)
+	}
+}
+
+func sendBatchMessage(ui packer.Ui, m UiBatchMessage) {
+	if m.Say {
+		ui.Say(m.Message)
+	} else {
+		ui.Message(m.Message)
+	}
+}
+
 func (u *UiServer) Ask(query string, reply *string) (err error) {
 	*reply, err = u.ui.Ask(query)
 	return
 }
 
+func (u *UiServer) Batch(messages []UiBatchMessage, reply *interface{}) error {
+	for _, m := range messages {
+		sendBatchMessage(u.ui, m)
+	}
+
+	*reply = nil
+	return nil
+}
+
 func (u *UiServer) Error(message *string, reply *interface{}) error {
 	u.ui.Error(*message)
 
@@ -84,6 +365,13 @@ func (u *UiServer) Message(message *string, reply *interface{}) error {
 	return nil
 }
 
+func (u *UiServer) Progress(p *packer.Progress, reply *interface{}) error {
+	packer.ReportProgress(u.ui, *p)
+
+	*reply = nil
+	return nil
+}
+
 func (u *UiServer) Say(message *string, reply *interface{}) error {
 	u.ui.Say(*message)
 
@@ -1,8 +1,10 @@
 package rpc
 
 import (
+	"github.com/mitchellh/packer/packer"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type testUi struct {
@@ -15,6 +17,8 @@ type testUi struct {
 	machineArgs    []string
 	messageCalled  bool
 	messageMessage string
+	progressCalled bool
+	progress       packer.Progress
 	sayCalled      bool
 	sayMessage     string
 }
@@ -41,17 +45,26 @@ func (u *testUi) Message(message string) {
 	u.messageMessage = message
 }
 
+func (u *testUi) Progress(p packer.Progress) {
+	u.progressCalled = true
+	u.progress = p
+}
+
 func (u *testUi) Say(message string) {
 	u.sayCalled = true
 	u.sayMessage = message
 }
 
+func TestUi_ImplementsProgressUi(t *testing.T) {
+	var _ packer.ProgressUi = new(Ui)
+}
+
 func TestUiRPC(t *testing.T) {
 	// Create the UI to test
 	ui := new(testUi)
 
 	// Start the RPC server
-	client, server := testClientServer(t)
+	client, server := TestClientServer(t)
 	defer client.Close()
 	defer server.Close()
 	server.RegisterUi(ui)
@@ -83,6 +96,15 @@ func TestUiRPC(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.errorMessage)
 	}
 
+	progress := packer.Progress{Message: "upload", Percent: 50}
+	packer.ReportProgress(uiClient, progress)
+	if !ui.progressCalled {
+		t.Fatal("progress should be called")
+	}
+	if ui.progress != progress {
+		t.Fatalf("bad: %#v", ui.progress)
+	}
+
 	uiClient.Say("message")
 	if ui.sayMessage != "message" {
 		t.Fatalf("bad: %#v", ui.errorMessage)
@@ -102,3 +124,239 @@ func TestUiRPC(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.machineArgs)
 	}
 }
+
+// slowUi is a Ui whose Say blocks until it is told to finish.
+type slowUi struct {
+	testUi
+	sayCh  chan string
+	doneCh chan struct{}
+}
+
+func (u *slowUi) Say(message string) {
+	u.sayCh <- message
+	<-u.doneCh
+}
+
+func TestUiClose(t *testing.T) {
+	ui := &slowUi{sayCh: make(chan string, 1), doneCh: make(chan struct{})}
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterUi(ui)
+	uiClient := client.Ui().(*Ui)
+
+	go uiClient.Say("foo")
+	if m := <-ui.sayCh; m != "foo" {
+		t.Fatalf("bad: %s", m)
+	}
+
+	closeCh := make(chan error, 1)
+	go func() {
+		closeCh <- uiClient.Close()
+	}()
+
+	// Close waits for the Say in flight to be acknowledged
+	select {
+	case <-closeCh:
+		t.Fatal("close should wait for the call")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(ui.doneCh)
+	select {
+	case err := <-closeCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close should finish")
+	}
+
+	// Calls after Close aren't sent
+	uiClient.Say("bar")
+	select {
+	case m := <-ui.sayCh:
+		t.Fatalf("bad: %s", m)
+	default:
+	}
+
+	if err := uiClient.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+// blockingAskUi is a Ui whose Ask never answers until it is closed.
+type blockingAskUi struct {
+	testUi
+	doneCh chan struct{}
+}
+
+func (u *blockingAskUi) Ask(query string) (string, error) {
+	<-u.doneCh
+	return "", nil
+}
+
+func TestUiAsk_timeout(t *testing.T) {
+	ui := &blockingAskUi{doneCh: make(chan struct{})}
+	defer close(ui.doneCh)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterUi(ui)
+
+	uiClient := client.Ui().(*Ui)
+	uiClient.AskTimeout = 50 * time.Millisecond
+	if _, err := uiClient.Ask("foo"); err == nil {
+		t.Fatal("should have error")
+	}
+
+	uiClient.AskDefault = "bar"
+	result, err := uiClient.Ask("foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "bar" {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// The questions that timed out aren't waited for
+	closeCh := make(chan error, 1)
+	go func() {
+		closeCh <- uiClient.Close()
+	}()
+
+	select {
+	case err := <-closeCh:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close should finish")
+	}
+}
+
+// orderUi is a Ui that records the order of all the output it is sent.
+type orderUi struct {
+	testUi
+	output []string
+}
+
+func (u *orderUi) Error(message string) {
+	u.output = append(u.output, "error: "+message)
+}
+
+func (u *orderUi) Message(message string) {
+	u.output = append(u.output, "message: "+message)
+}
+
+func (u *orderUi) Say(message string) {
+	u.output = append(u.output, "say: "+message)
+}
+
+func TestBufferedUi_ImplementsUi(t *testing.T) {
+	var _ packer.Ui = new(BufferedUi)
+}
+
+func TestBufferedUi(t *testing.T) {
+	ui := new(orderUi)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.RegisterUi(ui)
+
+	bufUi := NewBufferedUi(client.Ui(), time.Hour)
+	defer bufUi.Close()
+
+	bufUi.Say("foo")
+	bufUi.Message("bar")
+	if len(ui.output) != 0 {
+		t.Fatalf("bad: %#v", ui.output)
+	}
+
+	// Errors send the buffered output first so it stays in order
+	bufUi.Error("baz")
+	expected := []string{"say: foo", "message: bar", "error: baz"}
+	if !reflect.DeepEqual(ui.output, expected) {
+		t.Fatalf("bad: %#v", ui.output)
+	}
+
+	bufUi.Say("qux")
+	bufUi.Close()
+	expected = append(expected, "say: qux")
+	if !reflect.DeepEqual(ui.output, expected) {
+		t.Fatalf("bad: %#v", ui.output)
+	}
+}
+
+// oldUiServer is a UiServer from before Batch and Progress existed.
+type oldUiServer struct {
+	server *UiServer
+}
+
+func (s *oldUiServer) Message(message *string, reply *interface{}) error {
+	return s.server.Message(message, reply)
+}
+
+func (s *oldUiServer) Say(message *string, reply *interface{}) error {
+	return s.server.Say(message, reply)
+}
+
+func TestBufferedUi_oldHost(t *testing.T) {
+	ui := new(orderUi)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultUiEndpoint, &oldUiServer{
+		server: &UiServer{ui: ui},
+	})
+
+	bufUi := NewBufferedUi(client.Ui(), time.Hour)
+	bufUi.Say("foo")
+	bufUi.Message("bar")
+	bufUi.Close()
+
+	expected := []string{"say: foo", "message: bar"}
+	if !reflect.DeepEqual(ui.output, expected) {
+		t.Fatalf("bad: %#v", ui.output)
+	}
+}
+
+func TestUiProgress_oldHost(t *testing.T) {
+	ui := new(testUi)
+	client, server := TestClientServer(t)
+	defer client.Close()
+	defer server.Close()
+	server.server.RegisterName(DefaultUiEndpoint, &oldUiServer{
+		server: &UiServer{ui: ui},
+	})
+
+	packer.ReportProgress(client.Ui(), packer.Progress{Message: "upload", Percent: 50})
+	if ui.progressCalled {
+		t.Fatal("progress should not be called")
+	}
+	if ui.messageMessage != "upload (50%)" {
+		t.Fatalf("bad: %#v", ui.messageMessage)
+	}
+}
+
+func TestBufferedUi_interval(t *testing.T) {
+	ui := new(orderUi)
+	bufUi := NewBufferedUi(ui, 10*time.Millisecond)
+	defer bufUi.Close()
+
+	bufUi.Say("foo")
+
+	for i := 0; i < 100; i++ {
+		bufUi.l.Lock()
+		n := len(ui.output)
+		bufUi.l.Unlock()
+
+		if n > 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("output should be flushed")
+}
@@ -16,6 +16,10 @@ import (
 	"unicode"
 )
 
+// ErrCantAsk is returned by Ask from UIs that can't ask questions at all,
+// such as MachineReadableUi.
+var ErrCantAsk = errors.New("UI can't ask questions")
+
 type UiColor uint
 
 const (
@@ -38,6 +42,33 @@ type Ui interface {
 	Machine(string, ...string)
 }
 
+// Progress is a report of how far along a long running operation, such
+// as an upload, is.
+type Progress struct {
+	Message string
+
+	// Percent is how complete the operation is, from 0 to 100.
+	Percent int
+}
+
+// ProgressUi is implemented by a Ui that can render progress, for
+// example as a bar. It is optional, so use ReportProgress instead of
+// calling it directly.
+type ProgressUi interface {
+	Progress(Progress)
+}
+
+// ReportProgress reports progress to the given Ui. If the Ui can't render
+// progress, then the progress is shown as a normal message instead.
+func ReportProgress(ui Ui, p Progress) {
+	if pui, ok := ui.(ProgressUi); ok {
+		pui.Progress(p)
+		return
+	}
+
+	ui.Message(fmt.Sprintf("%s (%d%%)", p.Message, p.Percent))
+}
+
 // ColoredUi is a UI that is colored using terminal colors.
 type ColoredUi struct {
 	Color      UiColor
@@ -64,6 +95,30 @@ type BasicUi struct {
 	ErrorWriter io.Writer
 	l           sync.Mutex
 	interrupted bool
+
+	// AskTimeout, if set, is how long Ask waits for an answer, so that
+	// unattended runs don't hang on a question. If it times out, Ask
+	// returns AskDefault if that is set, and an error otherwise. This
+	// also applies to questions that remote plugins ask over RPC.
+	AskTimeout time.Duration
+	AskDefault string
+
+	// lineCh gets the lines read from Reader by a single goroutine that
+	// is started on the first Ask. An Ask that times out leaves the
+	// goroutine waiting, so the next Ask gets the line it reads.
+	lineCh   chan string
+	lineOnce sync.Once
+}
+
+// MultiUi is a UI that sends all output to each of the wrapped UIs, for
+// example to both the terminal and a log file. A panic in one UI doesn't
+// stop the others from getting the output. Questions are asked of the
+// first UI that is able to ask them: UIs whose Ask returns ErrCantAsk are
+// skipped, but any other error, such as the user interrupting the
+// question, is returned. A MultiUi can be served over RPC like any other
+// UI.
+type MultiUi struct {
+	Uis []Ui
 }
 
 // MachineReadableUi is a UI that only outputs machine-readable output
@@ -185,19 +240,28 @@ func (rw *BasicUi) Ask(query string) (string, error) {
 		}
 	}
 
-	result := make(chan string, 1)
-	go func() {
-		var line string
-		if _, err := fmt.Fscanln(rw.Reader, &line); err != nil {
-			log.Printf("ui: scan err: %s", err)
-		}
+	rw.lineOnce.Do(func() {
+		rw.lineCh = make(chan string)
+		go rw.readLines(rw.lineCh)
+	})
 
-		result <- line
-	}()
+	var timeout <-chan time.Time
+	if rw.AskTimeout > 0 {
+		timeout = time.After(rw.AskTimeout)
+	}
 
 	select {
-	case line := <-result:
+	case line := <-rw.lineCh:
 		return line, nil
+	case <-timeout:
+		fmt.Fprintln(rw.Writer)
+
+		if rw.AskDefault != "" {
+			log.Printf("ui: ask timed out, using default: %s", rw.AskDefault)
+			return rw.AskDefault, nil
+		}
+
+		return "", fmt.Errorf("timeout waiting for an answer after %s", rw.AskTimeout)
 	case <-sigCh:
 		// Print a newline so that any further output starts properly
 		// on a new line.
@@ -210,6 +274,25 @@ func (rw *BasicUi) Ask(query string) (string, error) {
 	}
 }
 
+// readLines sends each line read from Reader on the channel. Once the
+// Reader is exhausted the channel is closed, so every Ask after that
+// gets an empty answer.
+func (rw *BasicUi) readLines(ch chan<- string) {
+	defer close(ch)
+
+	for {
+		var line string
+		if _, err := fmt.Fscanln(rw.Reader, &line); err != nil {
+			log.Printf("ui: scan err: %s", err)
+			if err == io.EOF {
+				return
+			}
+		}
+
+		ch <- line
+	}
+}
+
 func (rw *BasicUi) Say(message string) {
 	rw.l.Lock()
 	defer rw.l.Unlock()
@@ -253,7 +336,7 @@ func (rw *BasicUi) Machine(t string, args ...string) {
 }
 
 func (u *MachineReadableUi) Ask(query string) (string, error) {
-	return "", errors.New("machine-readable UI can't ask")
+	return "", ErrCantAsk
 }
 
 func (u *MachineReadableUi) Say(message string) {
@@ -297,3 +380,57 @@ func (u *MachineReadableUi) Machine(category string, args ...string) {
 		}
 	}
 }
+
+// NewMultiUi returns a MultiUi that sends output to all the given UIs.
+func NewMultiUi(uis ...Ui) *MultiUi {
+	return &MultiUi{Uis: uis}
+}
+
+func (u *MultiUi) Ask(query string) (string, error) {
+	for _, ui := range u.Uis {
+		result, err := ui.Ask(query)
+		if errors.Is(err, ErrCantAsk) {
+			continue
+		}
+
+		return result, err
+	}
+
+	return "", ErrCantAsk
+}
+
+func (u *MultiUi) Say(message string) {
+	u.each(func(ui Ui) { ui.Say(message) })
+}
+
+func (u *MultiUi) Message(message string) {
+	u.each(func(ui Ui) { ui.Message(message) })
+}
+
+func (u *MultiUi) Error(message string) {
+	u.each(func(ui Ui) { ui.Error(message) })
+}
+
+func (u *MultiUi) Machine(t string, args ...string) {
+	u.each(func(ui Ui) { ui.Machine(t, args...) })
+}
+
+func (u *MultiUi) Progress(p Progress) {
+	u.each(func(ui Ui) { ReportProgress(ui, p) })
+}
+
+// each calls f with every wrapped UI, recovering from any panic so that
+// one broken UI doesn't keep output from the rest.
+func (u *MultiUi) each(f func(Ui)) {
+	for _, ui := range u.Uis {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[ERR] Panic in UI %T: %s", ui, r)
+				}
+			}()
+
+			f(ui)
+		}()
+	}
+}
@@ -2,9 +2,11 @@ package packer
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 // This reads the output from the bytes.Buffer in our test object
@@ -168,6 +170,54 @@ func TestBasicUi_Error(t *testing.T) {
 	}
 }
 
+func TestBasicUi_AskTimeout(t *testing.T) {
+	// Nothing is ever written to the reader
+	r, w := io.Pipe()
+	defer w.Close()
+
+	bufferUi := testUi()
+	bufferUi.Reader = r
+	bufferUi.AskTimeout = 10 * time.Millisecond
+
+	if _, err := bufferUi.Ask("continue?"); err == nil {
+		t.Fatal("should have error")
+	}
+
+	bufferUi.AskDefault = "yes"
+	result, err := bufferUi.Ask("continue?")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "yes" {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestBasicUi_AskAfterTimeout(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	bufferUi := testUi()
+	bufferUi.Reader = r
+	bufferUi.AskTimeout = 10 * time.Millisecond
+
+	if _, err := bufferUi.Ask("continue?"); err == nil {
+		t.Fatal("should have error")
+	}
+
+	// The answer to the next question isn't lost to the first one
+	go w.Write([]byte("yes\n"))
+
+	bufferUi.AskTimeout = 5 * time.Second
+	result, err := bufferUi.Ask("sure?")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "yes" {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
 func TestBasicUi_Say(t *testing.T) {
 	bufferUi := testUi()
 
@@ -188,6 +238,14 @@ func TestBasicUi_Say(t *testing.T) {
 	}
 }
 
+func TestReportProgress_message(t *testing.T) {
+	bufferUi := testUi()
+	ReportProgress(bufferUi, Progress{Message: "upload", Percent: 50})
+	if out := readWriter(bufferUi); out != "upload (50%)\n" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
 func TestMachineReadableUi_ImplUi(t *testing.T) {
 	var raw interface{}
 	raw = &MachineReadableUi{}
@@ -237,3 +295,79 @@ func TestMachineReadableUi(t *testing.T) {
 		t.Fatalf("bad: %#v", data)
 	}
 }
+
+// panicUi is a UI that panics on all output.
+type panicUi struct {
+	MachineReadableUi
+}
+
+func (u *panicUi) Say(string) {
+	panic("say")
+}
+
+func TestMultiUi_ImplUi(t *testing.T) {
+	var raw interface{}
+	raw = &MultiUi{}
+	if _, ok := raw.(Ui); !ok {
+		t.Fatalf("MultiUi must implement Ui")
+	}
+}
+
+func TestMultiUi(t *testing.T) {
+	first := testUi()
+	second := testUi()
+	ui := NewMultiUi(new(panicUi), first, second)
+
+	ui.Say("foo")
+	if out := readWriter(first); out != "foo\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := readWriter(second); out != "foo\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	ui.Error("bar")
+	if out := readErrorWriter(first); out != "bar\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := readErrorWriter(second); out != "bar\n" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestMultiUi_Ask(t *testing.T) {
+	bufferUi := testUi()
+	bufferUi.Reader.(*bytes.Buffer).WriteString("yes\n")
+
+	// The machine-readable UI can't ask, so the next one is used
+	ui := NewMultiUi(new(MachineReadableUi), bufferUi)
+	result, err := ui.Ask("continue?")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != "yes" {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	ui = NewMultiUi(new(MachineReadableUi))
+	if _, err := ui.Ask("continue?"); err != ErrCantAsk {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMultiUi_AskError(t *testing.T) {
+	interruptedUi := testUi()
+	interruptedUi.interrupted = true
+	bufferUi := testUi()
+	bufferUi.Reader.(*bytes.Buffer).WriteString("yes\n")
+
+	// The first UI could ask, so its error is returned rather than
+	// asking the next one
+	ui := NewMultiUi(interruptedUi, bufferUi)
+	if _, err := ui.Ask("continue?"); err == nil || err == ErrCantAsk {
+		t.Fatalf("err: %v", err)
+	}
+	if bufferUi.Reader.(*bytes.Buffer).Len() == 0 {
+		t.Fatal("the next UI shouldn't be asked")
+	}
+}